@@ -1,3 +1,5 @@
 module github.com/ondbyte/simp_mq/simp_broker
 
 go 1.16
+
+require golang.org/x/crypto v0.1.0
@@ -0,0 +1,143 @@
+package simp_broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+//what a client is trying to do on a topic
+type Action string
+
+const (
+	ActionPublish   Action = "publish"
+	ActionSubscribe Action = "subscribe"
+)
+
+//decides whether the authenticated client may perform the action on the topic, a returned error
+//is sent to the client as the reason of the denial
+type Authorizer func(deets *AuthDetails, action Action, topic string) error
+
+//a rule of an ACL, it applies when the client, the action and the topic all match
+type ACLRule struct {
+	//"allow" or "deny"
+	Effect string `json:"effect"`
+	//actions the rule applies to, every action when empty
+	Actions []Action `json:"actions,omitempty"`
+	//client ids the rule applies to, "*" matches any client
+	ClientIDs []string `json:"clientIds,omitempty"`
+	//roles the rule applies to, see AuthDetails.Roles, the rule applies to every client
+	//when neither client ids nor roles are given
+	Roles []string `json:"roles,omitempty"`
+	//topic patterns the rule applies to, "*" matches any run of characters
+	Topics []string `json:"topics"`
+}
+
+//ordered list of rules, the first rule matching a request decides it,
+//requests no rule matches are denied unless DefaultAllow is set
+type ACL struct {
+	Rules        []ACLRule `json:"rules"`
+	DefaultAllow bool      `json:"defaultAllow,omitempty"`
+}
+
+//reads an ACL from a json file, see ACL
+func LoadACL(file string) (*ACL, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	acl := &ACL{}
+	err = json.Unmarshal(bytes, acl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid acl file %s: %w", file, err)
+	}
+	for i, rule := range acl.Rules {
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("rule %d of acl file %s must have effect allow or deny", i, file)
+		}
+	}
+	return acl, nil
+}
+
+//Authorizer backed by the rules, use as SimpBroker.Authorizer = acl.Authorize
+func (acl *ACL) Authorize(deets *AuthDetails, action Action, topic string) error {
+	for _, rule := range acl.Rules {
+		if rule.matches(deets, action, topic) {
+			if rule.Effect == "allow" {
+				return nil
+			}
+			return fmt.Errorf("%s on topic %s is denied for client %s", action, topic, deets.ClientID)
+		}
+	}
+	if acl.DefaultAllow {
+		return nil
+	}
+	return fmt.Errorf("%s on topic %s is not allowed for client %s", action, topic, deets.ClientID)
+}
+
+func (rule *ACLRule) matches(deets *AuthDetails, action Action, topic string) bool {
+	if len(rule.Actions) > 0 {
+		found := false
+		for _, a := range rule.Actions {
+			if a == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.ClientIDs) > 0 || len(rule.Roles) > 0 {
+		found := false
+		for _, id := range rule.ClientIDs {
+			if id == "*" || id == deets.ClientID {
+				found = true
+				break
+			}
+		}
+		for _, role := range rule.Roles {
+			for _, clientRole := range deets.Roles {
+				if role == clientRole {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, pattern := range rule.Topics {
+		if matchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+//whether the topic matches the pattern, "*" in the pattern matches any run of characters
+func matchTopic(pattern string, topic string) bool {
+	p, t := 0, 0
+	//position of the last star in the pattern and where in the topic it started matching
+	star, mark := -1, 0
+	for t < len(topic) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, t
+			p++
+		case p < len(pattern) && pattern[p] == topic[t]:
+			p++
+			t++
+		case star >= 0:
+			//let the last star swallow one more character
+			mark++
+			p, t = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
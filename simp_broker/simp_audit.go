@@ -0,0 +1,218 @@
+package simp_broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//kind of a security relevant event
+type AuditKind string
+
+const (
+	AuditAuthSuccess     AuditKind = "auth.success"
+	AuditAuthFailure     AuditKind = "auth.failure"
+	AuditACLDenied       AuditKind = "acl.denied"
+	AuditSessionTakeover AuditKind = "session.takeover"
+	AuditSessionRejected AuditKind = "session.rejected"
+	AuditAdmin           AuditKind = "admin"
+)
+
+//a security relevant event of the broker
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Kind       AuditKind `json:"kind"`
+	Namespace  string    `json:"namespace,omitempty"`
+	ClientID   string    `json:"clientId,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Mechanism  string    `json:"mechanism,omitempty"`
+	Action     Action    `json:"action,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	//why a request failed or what an admin did
+	Reason string `json:"reason,omitempty"`
+}
+
+//recieves every audit event of the broker, called synchronously so it must not block for long
+//and must not call back into the broker
+type AuditSink func(event *AuditEvent)
+
+//sink handing every event to all the sinks in order
+func MultiAuditSink(sinks ...AuditSink) AuditSink {
+	return func(event *AuditEvent) {
+		for _, sink := range sinks {
+			sink(event)
+		}
+	}
+}
+
+//append only audit trail writing an event per line as json to a file, when the file grows over MaxSize
+//it is renamed to file.1, file.1 to file.2 and so on, keeping MaxBackups old files
+type JSONLinesAuditLog struct {
+	mu   sync.Mutex
+	path string
+	//bytes after which the file is rotated, never rotated when 0
+	MaxSize int64
+	//rotated files kept, the oldest is deleted beyond it
+	MaxBackups int
+	file       *os.File
+	size       int64
+}
+
+//opens the audit log appending to the file, see JSONLinesAuditLog
+func NewJSONLinesAuditLog(path string, maxSize int64, maxBackups int) (*JSONLinesAuditLog, error) {
+	log := &JSONLinesAuditLog{path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	err := log.open()
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (log *JSONLinesAuditLog) open() error {
+	file, err := os.OpenFile(log.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.file = file
+	log.size = info.Size()
+	return nil
+}
+
+//shifts the backups by one and starts a new file, must be called with the lock held
+func (log *JSONLinesAuditLog) rotate() error {
+	err := log.file.Close()
+	if err != nil {
+		return err
+	}
+	if log.MaxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", log.path, log.MaxBackups))
+		for i := log.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", log.path, i), fmt.Sprintf("%s.%d", log.path, i+1))
+		}
+		err = os.Rename(log.path, log.path+".1")
+	} else {
+		err = os.Remove(log.path)
+	}
+	if err != nil {
+		return err
+	}
+	return log.open()
+}
+
+//AuditSink writing the event to the file, use as SimpBroker.AuditSink = log.Audit
+func (log *JSONLinesAuditLog) Audit(event *AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("theres error marshalling audit event simp_audit:Audit()")
+		return
+	}
+	line = append(line, '\n')
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.file == nil {
+		return
+	}
+	if log.MaxSize > 0 && log.size > 0 && log.size+int64(len(line)) > log.MaxSize {
+		err = log.rotate()
+		if err != nil {
+			fmt.Println("failed to rotate audit log", err)
+			if log.file == nil {
+				return
+			}
+		}
+	}
+	n, err := log.file.Write(line)
+	log.size += int64(n)
+	if err != nil {
+		fmt.Println("failed to write audit log", err)
+	}
+}
+
+//closes the file, later events are dropped
+func (log *JSONLinesAuditLog) Close() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.file == nil {
+		return nil
+	}
+	err := log.file.Close()
+	log.file = nil
+	return err
+}
+
+//AuditSink publishing every event as json on the topic of the namespace the event belongs to, so the clients
+//of a namespace only ever see the events of their own namespace. failed authentications belong to no
+//namespace yet and are left out, follow them with AdminAuditSink. guard the topic with the Authorizer
+func (broker *SimpBroker) SystemTopicAuditSink(topic string) AuditSink {
+	return func(event *AuditEvent) {
+		if event.Kind == AuditAuthFailure {
+			return
+		}
+		broker.publishAudit(event.Namespace, topic, event)
+	}
+}
+
+//AuditSink publishing the events of every namespace, failed authentications included, on the topic of
+//the given namespace. it shows the whole broker, so keep the namespace to the operators
+func (broker *SimpBroker) AdminAuditSink(namespace string, topic string) AuditSink {
+	return func(event *AuditEvent) {
+		broker.publishAudit(namespace, topic, event)
+	}
+}
+
+//publishes the event as json on the topic of the namespace, dropped if the namespace does not exist
+func (broker *SimpBroker) publishAudit(namespace string, topic string, event *AuditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("theres error marshalling audit event simp_audit:publishAudit()")
+		return
+	}
+	deets := &PubDetails{Topic: topic, Data: data}
+	payload, err := deets.Marshal()
+	if err != nil {
+		return
+	}
+	broker.nsMu.RLock()
+	ns := broker.namespaces[namespace]
+	broker.nsMu.RUnlock()
+	if ns == nil {
+		return
+	}
+	broker.routeMu.Lock()
+	err = broker.route(ns, payload, deets)
+	broker.routeMu.Unlock()
+	if err != nil {
+		fmt.Println("unable to publish audit event", err)
+	}
+}
+
+//hands the event about the connection to the AuditSink if there is one
+func (broker *SimpBroker) audit(kind AuditKind, simpConn *SimpClientConn, event *AuditEvent) {
+	if broker.AuditSink == nil {
+		return
+	}
+	if event == nil {
+		event = &AuditEvent{}
+	}
+	event.Time = time.Now().UTC()
+	event.Kind = kind
+	if simpConn != nil {
+		event.RemoteAddr = simpConn.NetConn.RemoteAddr().String()
+		if simpConn.AuthDetails != nil {
+			event.Namespace = simpConn.AuthDetails.Namespace
+			event.ClientID = simpConn.AuthDetails.ClientID
+			event.Mechanism = simpConn.AuthDetails.Mechanism
+			if len(event.Mechanism) == 0 {
+				event.Mechanism = MechanismPlain
+			}
+		}
+	}
+	broker.AuditSink(event)
+}
@@ -0,0 +1,320 @@
+package simp_broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//a client of a users file
+type User struct {
+	ClientID string `json:"clientId"`
+	//bcrypt hash of the password the client sends as its token, see HashPassword
+	PasswordHash string   `json:"passwordHash"`
+	Roles        []string `json:"roles,omitempty"`
+	//namespace the client belongs to, the default namespace when empty
+	Namespace string `json:"namespace,omitempty"`
+}
+
+//bcrypt hash unknown clients are checked against, with the cost of HashPassword
+const dummyPasswordHash = "$2a$10$JIfc7rHStf63yuq2RaeSweZLhWAfnCXZmou2OJ4gUwEiVLdu1BgNG"
+
+//hashes a password for a users file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+//Authenticator checking the token of a client against its bcrypt hashed password in a json users file
+//of the form {"users": [{"clientId": "...", "passwordHash": "...", "roles": ["..."], "namespace": "..."}]},
+//the roles of the user are handed to the Authorizer and the client is put in the namespace of the user
+func UsersFileAuthenticator(file string) (Authenticator, error) {
+	users, err := loadUsersFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return func(deets *AuthDetails) error {
+		user := users[deets.ClientID]
+		hash := dummyPasswordHash
+		if user != nil {
+			hash = user.PasswordHash
+		}
+		//an unknown client is checked against a hash as well, so it takes as long as a wrong password
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(deets.Token))
+		if err != nil || user == nil {
+			return errors.New("failed to authenticate")
+		}
+		deets.Roles = user.Roles
+		deets.Namespace = user.Namespace
+		return nil
+	}, nil
+}
+
+//CertIdentities giving a client its roles and namespace from the users file, for CertAuthenticator,
+//clients not in the file are refused
+func UsersFileIdentities(file string) (CertIdentities, error) {
+	users, err := loadUsersFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return func(clientID string) ([]string, string, error) {
+		user := users[clientID]
+		if user == nil {
+			return nil, "", errors.New("failed to authenticate")
+		}
+		return user.Roles, user.Namespace, nil
+	}, nil
+}
+
+//users of the users file by client id
+func loadUsersFile(file string) (map[string]*User, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	usersFile := &struct {
+		Users []*User `json:"users"`
+	}{}
+	err = json.Unmarshal(bytes, usersFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", file, err)
+	}
+	users := make(map[string]*User)
+	for _, user := range usersFile.Users {
+		users[user.ClientID] = user
+	}
+	return users, nil
+}
+
+//claims carried by a signed token
+type TokenClaims struct {
+	//client id the token was issued to
+	Subject string `json:"sub"`
+	//unix time after which the token is rejected, never expires when 0
+	ExpiresAt int64 `json:"exp,omitempty"`
+	//unix time before which the token is rejected
+	NotBefore int64    `json:"nbf,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	//namespace the client belongs to, the default namespace when empty
+	Namespace string `json:"ns,omitempty"`
+}
+
+//checks the time bounds and the subject of the claims against the client
+func (claims *TokenClaims) valid(clientID string) error {
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+	if claims.Subject != clientID {
+		return errors.New("token was not issued to this client")
+	}
+	return nil
+}
+
+//signs the claims into a token accepted by HMACAuthenticator with the same secret,
+//the token is the base64url encoded claims and their HMAC-SHA256 joined by a dot
+func SignHMACToken(secret []byte, claims *TokenClaims) (string, error) {
+	bytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(bytes)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+//Authenticator verifying tokens made by SignHMACToken, the token must be issued to the client id
+//and not be expired, roles of the claims are handed to the Authorizer
+func HMACAuthenticator(secret []byte) Authenticator {
+	return func(deets *AuthDetails) error {
+		parts := strings.Split(deets.Token, ".")
+		if len(parts) != 2 {
+			return errors.New("malformed token")
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return errors.New("malformed token")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0]))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("invalid token signature")
+		}
+		bytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return errors.New("malformed token")
+		}
+		claims := &TokenClaims{}
+		err = json.Unmarshal(bytes, claims)
+		if err != nil {
+			return errors.New("malformed token claims")
+		}
+		err = claims.valid(deets.ClientID)
+		if err != nil {
+			return err
+		}
+		deets.Roles = claims.Roles
+		deets.Namespace = claims.Namespace
+		return nil
+	}
+}
+
+//a key of a json web key set
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	//rsa
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	//ec
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	//symmetric
+	K string `json:"k,omitempty"`
+}
+
+//keys JWTs are verified against
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+//reads a json web key set from a file, RSA, P-256 EC and symmetric keys are supported
+func LoadJWKS(file string) (*JWKSet, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keySet := &JWKSet{}
+	err = json.Unmarshal(bytes, keySet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key set file %s: %w", file, err)
+	}
+	return keySet, nil
+}
+
+//Authenticator verifying JWTs signed with RS256, ES256 or HS256 by a key of the set, picked by the
+//kid of the token header. the sub claim must be the client id, exp and nbf are enforced and the
+//roles claim is handed to the Authorizer
+func JWTAuthenticator(keySet *JWKSet) Authenticator {
+	return func(deets *AuthDetails) error {
+		parts := strings.Split(deets.Token, ".")
+		if len(parts) != 3 {
+			return errors.New("malformed jwt")
+		}
+		header := &struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}{}
+		err := decodeJWTPart(parts[0], header)
+		if err != nil {
+			return err
+		}
+		var key *JWK
+		for _, k := range keySet.Keys {
+			if k.Kid == header.Kid {
+				key = k
+				break
+			}
+		}
+		if key == nil {
+			return fmt.Errorf("no key with kid %q to verify the jwt", header.Kid)
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return errors.New("malformed jwt signature")
+		}
+		err = verifyJWTSignature(key, header.Alg, []byte(parts[0]+"."+parts[1]), signature)
+		if err != nil {
+			return err
+		}
+		claims := &TokenClaims{}
+		err = decodeJWTPart(parts[1], claims)
+		if err != nil {
+			return err
+		}
+		err = claims.valid(deets.ClientID)
+		if err != nil {
+			return err
+		}
+		deets.Roles = claims.Roles
+		deets.Namespace = claims.Namespace
+		return nil
+	}
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed jwt")
+	}
+	err = json.Unmarshal(bytes, v)
+	if err != nil {
+		return errors.New("malformed jwt")
+	}
+	return nil
+}
+
+//verifies the signature with the key, the algorithm of the token must fit the type of the key
+//so a public key can never be used as an hmac secret
+func verifyJWTSignature(key *JWK, alg string, signed []byte, signature []byte) error {
+	if len(key.Alg) > 0 && key.Alg != alg {
+		return fmt.Errorf("key %s does not allow algorithm %s", key.Kid, alg)
+	}
+	digest := sha256.Sum256(signed)
+	switch {
+	case alg == "HS256" && key.Kty == "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(key.K)
+		if err != nil {
+			return fmt.Errorf("invalid key %s", key.Kid)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	case alg == "RS256" && key.Kty == "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		e, errE := base64.RawURLEncoding.DecodeString(key.E)
+		if errN != nil || errE != nil {
+			return fmt.Errorf("invalid key %s", key.Kid)
+		}
+		publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	case alg == "ES256" && key.Kty == "EC" && key.Crv == "P-256":
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil || len(signature) != 64 {
+			return errors.New("invalid jwt signature")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s is not supported with key %s", alg, key.Kid)
+}
@@ -0,0 +1,51 @@
+package simp_broker
+
+import (
+	"fmt"
+)
+
+//routes every publish of the batch on its own, a publish refused by the acl or the rate limit does not
+//hold back the others, the batchAck lists the refused ones with their reason
+func (broker *SimpBroker) publishBatch(simpConn *SimpClientConn, data *SimpData) {
+	deets, err := data.GetBatchDetails()
+	if err != nil {
+		fmt.Println("theres error getting batch details simp_broker:publishBatch()")
+		simpConn.respondError(data.ID, err)
+		return
+	}
+	failed := make(map[string]string)
+	for _, message := range deets.Messages {
+		if message.Pub == nil {
+			failed[message.ID] = "batched message without a publish"
+			continue
+		}
+		err = broker.authorize(simpConn, ActionPublish, message.Pub.Topic)
+		if err == nil {
+			err = broker.admitPublish(simpConn, len(message.Pub.Data))
+		}
+		if err != nil {
+			failed[message.ID] = err.Error()
+			continue
+		}
+		payload, err := message.Pub.Marshal()
+		if err != nil {
+			failed[message.ID] = err.Error()
+			continue
+		}
+		broker.routeMu.Lock()
+		err = broker.route(simpConn.namespace, payload, message.Pub)
+		broker.routeMu.Unlock()
+		if err != nil {
+			failed[message.ID] = err.Error()
+		}
+	}
+	payload, err := (&BatchDetails{Failed: failed}).Marshal()
+	if err != nil {
+		fmt.Println("unable to acknowledge batch", err)
+		return
+	}
+	err = simpConn.respond(&SimpData{Type: batchAck, ID: data.ID, Payload: payload})
+	if err != nil {
+		fmt.Println("error responding")
+	}
+}
@@ -1,20 +1,33 @@
 package simp_broker
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 type SubScribers struct {
+	mu  sync.RWMutex
 	all map[string]map[string]*SimpClientConn
+	//shared subscriptions per topic by group name
+	groups map[string]map[string]*consumerGroup
+	//durable pull subscriptions per topic by client id
+	pulls map[string]map[string]*pullSubscription
 }
 
 func (SubScribers *SubScribers) init() {
 	SubScribers.all = make(map[string]map[string]*SimpClientConn)
+	SubScribers.groups = make(map[string]map[string]*consumerGroup)
+	SubScribers.pulls = make(map[string]map[string]*pullSubscription)
 }
 
 func (SubScribers *SubScribers) addForTopic(topic string, simpConn *SimpClientConn) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
 	all := SubScribers.all[topic]
 	if all == nil {
 		all = make(map[string]*SimpClientConn)
@@ -24,6 +37,8 @@ func (SubScribers *SubScribers) addForTopic(topic string, simpConn *SimpClientCo
 }
 
 func (SubScribers *SubScribers) removeForTopic(topic string, simpConn *SimpClientConn) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
 	all := SubScribers.all[topic]
 	if all == nil {
 		return
@@ -32,16 +47,53 @@ func (SubScribers *SubScribers) removeForTopic(topic string, simpConn *SimpClien
 	SubScribers.all[topic] = all
 }
 
+//removes the connection from every topic it subscribed to
+func (SubScribers *SubScribers) removeFromAll(simpConn *SimpClientConn) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	for _, all := range SubScribers.all {
+		if all[simpConn.Id] == simpConn {
+			delete(all, simpConn.Id)
+		}
+	}
+	for topic := range SubScribers.groups {
+		SubScribers.leaveGroupsLocked(topic, simpConn)
+	}
+}
+
+//snapshot of the connections a message published on the topic must be delivered to,
+//every subscriber of the topic plus the owner of the key's partition in each shared group
+func (SubScribers *SubScribers) forMessage(topic string, key string) []*SimpClientConn {
+	SubScribers.mu.RLock()
+	defer SubScribers.mu.RUnlock()
+	all := make([]*SimpClientConn, 0, len(SubScribers.all[topic])+len(SubScribers.groups[topic]))
+	for _, simpConn := range SubScribers.all[topic] {
+		all = append(all, simpConn)
+	}
+	for _, group := range SubScribers.groups[topic] {
+		if owner := group.owners[group.partitionFor(key)]; owner != nil {
+			all = append(all, owner)
+		}
+	}
+	return all
+}
+
 //a simple broker which you can publish to subscribe to
 type SimpBroker struct {
 	//unique id
 	Id string
 	//port the broker must try to run on or fail
 	Port string
-	//topic subscribers
-	subscribers *SubScribers
-	//connectsions with their ids
-	allConnections map[string]*SimpClientConn
+	//isolated tenants by name, each with its own subscribers and connections, see Namespace
+	namespaces map[string]*Namespace
+	nsMu       sync.RWMutex
+	//guards the connections of every namespace
+	connMu sync.Mutex
+	//connections of all namespaces
+	connectionCount uint
+	//held while a message or a committed transaction is routed to subscribers,
+	//so the messages of a transaction become visible together
+	routeMu sync.Mutex
 	//internal channel recieves event when the server gets closed so any go routines depended on the server can close
 	serverClosingEvent chan bool
 	//whether the broker is running
@@ -51,8 +103,65 @@ type SimpBroker struct {
 	MaxMessageBuffer uint
 	//validate token from a client for a successful connection
 	Authenticator Authenticator
+	//credentials of clients authenticating with SCRAM-SHA-256, the token never crosses the wire with it,
+	//the mechanism is offered to clients when set, the Authenticator is not called for such clients
+	ScramCredentials ScramCredentialStore
+	//random key the salts answered for unknown SCRAM clients are derived from
+	scramMockKey []byte
+	//refuse clients sending their token as is, use with ScramCredentials
+	DisablePlainAuth bool
+	//decides whether a client may publish or subscribe to a topic, every request is allowed when nil,
+	//see ACL for a rule based implementation
+	Authorizer Authorizer
+	//what happens when a client authenticates with the id of a connected client, the old connection
+	//is kicked and its session taken over by default, see ConflictPolicy
+	ClientIDConflict ConflictPolicy
+	//limits of every client without its own entry in ClientLimits, no limits when nil
+	Limits *Limits
+	//limits by client id, overriding Limits
+	ClientLimits map[string]*Limits
+	//most clients connected at once, newcomers are refused beyond it, unlimited when 0
+	MaxConnections uint
+	//create the namespace a client is authenticated into if it does not exist, otherwise
+	//such clients are refused until the namespace is added with AddNamespace
+	AutoCreateNamespaces bool
+	//recieves authentications, acl denials, session takeovers and admin actions, see JSONLinesAuditLog
+	//and SystemTopicAuditSink
+	AuditSink AuditSink
 	//if no authentication data is recieved from a client, connection will be dropped after this duration
 	DropNoAuthConnectionAfter time.Duration
+	//number of priority levels a message can be published with, 0 being the lowest,
+	//higher priorities are clamped to the highest level, defaults to 10
+	PriorityLevels uint
+	//a waiting lower priority message is delivered after higher priorities were served
+	//these many times in a row on the same topic, so low priorities still drain, defaults to 32
+	StarvationLimit uint
+	//number of partitions a topic is split into for shared subscriptions, messages with the
+	//same key go to the same partition and the same group member, defaults to 16
+	PartitionsPerTopic uint
+	//most messages a pull subscription holds, the oldest are dropped beyond it, defaults to 10000
+	MaxPullBacklog uint
+	//most messages the open transactions of a connection stage at once, a transaction staging more
+	//fails on commit, defaults to 10000
+	MaxStagedMessages uint
+	//most bytes the open transactions of a connection stage at once, defaults to 64MB
+	MaxStagedBytes uint
+	//longest a fetch request may wait for messages to arrive, defaults to 30 seconds
+	MaxFetchWait time.Duration
+	//most fetch requests of a connection waiting at once, more are refused, defaults to 16
+	MaxFetchesPerConnection uint
+	//pull subscriptions, the messages they hold and their acknowledged offsets are kept in a journal in
+	//this directory and restored when the broker serves again, a publish or committed transaction is on
+	//disk before it is acknowledged and survives a crash whole or not at all. kept in memory only when empty
+	DataDir string
+	//the journal in the DataDir is compacted to the current state whenever it grows past this many bytes,
+	//defaults to 64MB
+	MaxJournalSize uint
+	//journal in the DataDir
+	store *journal
+	//when set the broker only accepts tls connections, set ClientAuth to tls.RequireAndVerifyClientCert
+	//for mutual tls, see LoadTLSConfig
+	TLSConfig *tls.Config
 }
 
 //non blocking,
@@ -63,20 +172,78 @@ func (broker *SimpBroker) Serve() (err error) {
 	if broker.MaxMessageBuffer == 0 {
 		broker.MaxMessageBuffer = 1024
 	}
-	broker.subscribers = &SubScribers{}
-	broker.subscribers.init()
-	broker.allConnections = make(map[string]*SimpClientConn)
+	if broker.PriorityLevels == 0 {
+		broker.PriorityLevels = 10
+	}
+	if broker.StarvationLimit == 0 {
+		broker.StarvationLimit = 32
+	}
+	if broker.PartitionsPerTopic == 0 {
+		broker.PartitionsPerTopic = 16
+	}
+	if broker.MaxPullBacklog == 0 {
+		broker.MaxPullBacklog = 10000
+	}
+	if broker.MaxStagedMessages == 0 {
+		broker.MaxStagedMessages = 10000
+	}
+	if broker.MaxStagedBytes == 0 {
+		broker.MaxStagedBytes = 64 << 20
+	}
+	if broker.MaxJournalSize == 0 {
+		broker.MaxJournalSize = 64 << 20
+	}
+	if broker.MaxFetchWait == 0 {
+		broker.MaxFetchWait = time.Second * 30
+	}
+	if broker.MaxFetchesPerConnection == 0 {
+		broker.MaxFetchesPerConnection = 16
+	}
+	if broker.ScramCredentials != nil && broker.scramMockKey == nil {
+		broker.scramMockKey = make([]byte, 32)
+		_, err = rand.Read(broker.scramMockKey)
+		if err != nil {
+			return err
+		}
+	}
+	broker.nsMu.Lock()
+	if broker.namespaces == nil {
+		broker.namespaces = make(map[string]*Namespace)
+	}
+	if broker.namespaces[""] == nil {
+		defaultNamespace := &Namespace{}
+		defaultNamespace.init()
+		broker.namespaces[""] = defaultNamespace
+	}
+	broker.nsMu.Unlock()
+	if len(broker.DataDir) > 0 {
+		err = broker.openStore()
+		if err != nil {
+			return err
+		}
+	}
 	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%s", broker.Port))
 	if err != nil {
+		if broker.store != nil {
+			broker.store.close()
+		}
 		return err
 	}
+	if broker.TLSConfig != nil {
+		ln = tls.NewListener(ln, broker.TLSConfig)
+	}
+	broker.serverClosingEvent = make(chan bool)
 
 	go func() {
 		for {
 			//wait for new connection
 			conn, err := ln.Accept()
 			if err != nil {
+				if !broker.Running {
+					return
+				}
 				fmt.Println(err)
+				continue
 			}
 			//new tcp connection
 			broker.newIncomingConnection(conn)
@@ -85,31 +252,51 @@ func (broker *SimpBroker) Serve() (err error) {
 	}()
 	go func() {
 		fmt.Printf("SimpBroker is running on port %s\n", ln.Addr().String())
-		for {
-			_, more := <-broker.serverClosingEvent
-			if !more {
-				broker.Running = false
-				ln.Close()
-				fmt.Println("SimpMQ has shut down")
+		_, more := <-broker.serverClosingEvent
+		if !more {
+			broker.Running = false
+			ln.Close()
+			broker.closeAllConnections()
+			if broker.store != nil {
+				broker.store.close()
 			}
+			fmt.Println("SimpMQ has shut down")
 		}
 	}()
 	broker.Running = true
-	broker.serverClosingEvent = make(chan bool)
 	return nil
 }
 
 //handles any new connections from clients
 func (broker *SimpBroker) newIncomingConnection(conn net.Conn) {
 	go func() {
-		simpConn := &SimpClientConn{NetConn: conn, BufferSize: broker.MaxMessageBuffer, Authenticator: broker.Authenticator}
-		broker.allConnections[simpConn.Id] = simpConn
+		simpConn := &SimpClientConn{
+			NetConn:          conn,
+			BufferSize:       broker.MaxMessageBuffer,
+			Authenticator:    broker.Authenticator,
+			ScramCredentials: broker.ScramCredentials,
+			scramMockKey:     broker.scramMockKey,
+			DisablePlainAuth: broker.DisablePlainAuth,
+		}
 		err := broker.authenticateNewSimpConnection(simpConn)
 		if err != nil {
 			fmt.Println(err)
+			broker.audit(AuditAuthFailure, simpConn, &AuditEvent{Reason: err.Error()})
+			//tell the client why before dropping it
+			payload, _ := (&ErrorDetails{Message: err.Error()}).Marshal()
+			respond(&SimpData{Type: nack, Payload: payload}, conn)
+			conn.Close()
 			return
 		}
-		broker.afterAuthLoopForConn(simpConn)
+		broker.audit(AuditAuthSuccess, simpConn, nil)
+		go simpConn.dispatcher.run()
+		err = broker.afterAuthLoopForConn(simpConn)
+		if errors.Is(err, errClientDisconnected) {
+			fmt.Printf("client %s disconnected cleanly\n", simpConn.Id)
+		} else {
+			fmt.Printf("dropping connection of client %s: %v\n", simpConn.Id, err)
+		}
+		broker.dropConnection(simpConn)
 	}()
 }
 
@@ -121,79 +308,353 @@ func (broker *SimpBroker) authenticateNewSimpConnection(simpConn *SimpClientConn
 	if err != nil {
 		return err
 	} else {
+		simpConn.dispatcher = newDispatcher(broker.PriorityLevels, broker.StarvationLimit, simpConn.respond)
+		sessionDeets, err := broker.registerConnection(simpConn)
+		if err != nil {
+			return err
+		}
 		authData.Type = authAck
 		err = simpConn.respond(authData)
 		if err != nil {
-			simpConn.close()
+			broker.dropConnection(simpConn)
+			return err
+		}
+		//the smaller of the two limits holds for both sides
+		sessionDeets.MaxFrameSize = broker.MaxMessageBuffer
+		if wanted := simpConn.AuthDetails.MaxFrameSize; wanted > 0 && wanted < sessionDeets.MaxFrameSize {
+			sessionDeets.MaxFrameSize = wanted
+		}
+		payload, err := sessionDeets.Marshal()
+		if err != nil {
+			broker.dropConnection(simpConn)
 			return err
 		}
+		err = simpConn.respond(&SimpData{Type: session, ID: authData.ID, Payload: payload})
+		if err != nil {
+			broker.dropConnection(simpConn)
+			return err
+		}
+		simpConn.BufferSize = sessionDeets.MaxFrameSize
 	}
 	return nil
 }
 
-//handles further data after authentication of the connection
+//removes every trace of the connection from the broker and closes it
+func (broker *SimpBroker) dropConnection(simpConn *SimpClientConn) {
+	broker.unregisterConnection(simpConn)
+	if simpConn.namespace != nil {
+		simpConn.namespace.subscribers.removeFromAll(simpConn)
+	}
+	if simpConn.dispatcher != nil {
+		simpConn.dispatcher.close()
+	}
+	simpConn.close()
+}
+
+//checks the request of the connection against the Authorizer of its namespace or else the broker's
+func (broker *SimpBroker) authorize(simpConn *SimpClientConn, action Action, topic string) error {
+	authorizer := simpConn.namespace.Authorizer
+	if authorizer == nil {
+		authorizer = broker.Authorizer
+	}
+	if authorizer == nil {
+		return nil
+	}
+	err := authorizer(simpConn.AuthDetails, action, topic)
+	if err != nil {
+		broker.audit(AuditACLDenied, simpConn, &AuditEvent{Action: action, Topic: topic, Reason: err.Error()})
+	}
+	return err
+}
+
+//a published message on its way to the subscribers
+type routedMessage struct {
+	payload []byte
+	deets   *PubDetails
+}
+
+//hands the published message to the dispatcher of every subscriber it must reach,
+//subscribers recieve it through their dispatcher so a slow subscriber does not hold up the publisher,
+//the message only reaches subscribers of the namespace, call with routeMu held.
+//the message gets an id of its own so ids seen by subscribers are unique whatever the publisher sent
+func (broker *SimpBroker) route(ns *Namespace, payload []byte, deets *PubDetails) error {
+	return broker.routeAll(ns, []*routedMessage{{payload: payload, deets: deets}})
+}
+
+//routes the messages together, with a DataDir the ones reaching a pull subscription are written to
+//the journal in a single record first, fails without routing any of them if that fails.
+//a subscriber which negotiated a frame size too small for a message is skipped, the others still get it
+func (broker *SimpBroker) routeAll(ns *Namespace, messages []*routedMessage) error {
+	ids := make([]string, len(messages))
+	subscribers := make([][]*SimpClientConn, len(messages))
+	record := &journalRecord{Op: journalPub, Namespace: ns.Name}
+	for i, msg := range messages {
+		ids[i] = newID()
+		subscribers[i] = ns.subscribers.forMessage(msg.deets.Topic, msg.deets.Key)
+		size, err := frameSize(&SimpData{Type: pub, ID: ids[i], Payload: msg.payload})
+		if err != nil {
+			return err
+		}
+		fitting := make([]*SimpClientConn, 0, len(subscribers[i]))
+		for _, subscriber := range subscribers[i] {
+			if subscriber.BufferSize > 0 && size > subscriber.BufferSize {
+				fmt.Printf("skipping subscriber %s, message of %d bytes on %s is larger than its %d\n", subscriber.AuthDetails.ClientID, size, msg.deets.Topic, subscriber.BufferSize)
+				continue
+			}
+			fitting = append(fitting, subscriber)
+		}
+		subscribers[i] = fitting
+		if broker.store != nil && len(ns.subscribers.pullsForTopic(msg.deets.Topic)) > 0 {
+			record.Messages = append(record.Messages, &journalMessage{Topic: msg.deets.Topic, ID: ids[i], Payload: msg.payload})
+		}
+	}
+	if len(record.Messages) > 0 {
+		err := broker.writeJournal(record, true)
+		if err != nil {
+			return fmt.Errorf("unable to store the message: %w", err)
+		}
+	}
+	for i, msg := range messages {
+		for _, subscriber := range subscribers[i] {
+			subscriber.dispatcher.enqueue(msg.deets.Topic, msg.deets.Priority, &SimpData{Type: pub, ID: ids[i], Payload: msg.payload})
+		}
+		//pull subscriptions hold the message until their client fetches it
+		for _, ps := range ns.subscribers.pullsForTopic(msg.deets.Topic) {
+			ps.push(ids[i], msg.payload, msg.deets)
+		}
+	}
+	return nil
+}
+
+//routes every staged message of the transaction at once, messages that cannot be read are skipped
+func (broker *SimpBroker) commitTransaction(ns *Namespace, staged []*SimpData) error {
+	messages := make([]*routedMessage, 0, len(staged))
+	for _, data := range staged {
+		deets, err := data.GetPubDetails()
+		if err != nil {
+			fmt.Println("theres error getting pub details simp_broker:commitTransaction()")
+			continue
+		}
+		messages = append(messages, &routedMessage{payload: data.Payload, deets: deets})
+	}
+	broker.routeMu.Lock()
+	defer broker.routeMu.Unlock()
+	return broker.routeAll(ns, messages)
+}
+
+//handles further data after authentication of the connection,
+//returns when the connection cannot be read from anymore
 func (broker *SimpBroker) afterAuthLoopForConn(simpConn *SimpClientConn) (err error) {
+	publishes := make(chan *SimpData, 256)
+	published := make(chan struct{})
+	go broker.publishLoop(simpConn, publishes, published)
+	defer func() {
+		//publishes read before the connection ended are still handled
+		close(publishes)
+		<-published
+	}()
 	for {
 		nextData, err := simpConn.nextDataFromConnection()
-		if err == nil {
-			switch nextData.Type {
-			case pub:
-				{
-					deets, err := nextData.GetPubDetails()
-					if err != nil {
-						fmt.Println("theres error getting pub details simp_broker:afterAuthLoopForConn()")
-					}
-					for _, subscriber := range broker.subscribers.all[deets.Topic] {
-						subscriber.respond(nextData)
-					}
-					//send acknkowledge
-					nextData.Type = pubAck
-					err = simpConn.respond(nextData)
-					if err != nil {
-						fmt.Println("error responding")
-					}
+		if err != nil {
+			return err
+		}
+		switch nextData.Type {
+		case pub, batch, txPub, txCommit, txAbort:
+			{
+				//a throttled publisher waits on its own, its acks, credits and subscriptions are still read
+				publishes <- nextData
+				break
+			}
+		case sub:
+			{
+				deets, err := nextData.GetSubDetails()
+				if err != nil {
+					fmt.Println("theres error getting sub details simp_broker:afterAuthLoopForConn()")
+				}
+				err = broker.authorize(simpConn, ActionSubscribe, deets.Topic)
+				if err == nil {
+					err = broker.admitSubscription(simpConn, deets.Topic)
+				}
+				if err != nil {
+					simpConn.respondError(nextData.ID, err)
 					break
 				}
-			case sub:
-				{
-					deets, err := nextData.GetSubDetails()
-					if err != nil {
-						fmt.Println("theres error getting sub details simp_broker:afterAuthLoopForConn()")
-					}
-					broker.subscribers.addForTopic(deets.Topic, simpConn)
-					//send acknkowledge
-					nextData.Type = subAck
-					err = simpConn.respond(nextData)
+				if deets.Credits > 0 && !deets.Pull {
+					simpConn.dispatcher.limit(deets.Topic, deets.Credits)
+				}
+				switch {
+				case deets.Pull:
+					//a new session of the durable subscription starts after the last acknowledged message
+					broker.openPull(simpConn, deets.Topic).rewind()
+				case len(deets.Group) > 0:
+					simpConn.namespace.subscribers.joinGroup(deets.Topic, deets.Group, broker.PartitionsPerTopic, simpConn)
+				default:
+					simpConn.namespace.subscribers.addForTopic(deets.Topic, simpConn)
+				}
+				//send acknkowledge
+				nextData.Type = subAck
+				err = simpConn.respond(nextData)
+				if err != nil {
+					fmt.Println("error responding")
+				}
+				break
+			}
+		case unsub:
+			{
+				deets, err := nextData.GetSubDetails()
+				if err != nil {
+					fmt.Println("theres error getting sub details simp_broker:afterAuthLoopForConn()")
+				}
+				if deets.Pull {
+					broker.closePull(simpConn, deets.Topic)
+				}
+				simpConn.namespace.subscribers.removeForTopic(deets.Topic, simpConn)
+				simpConn.namespace.subscribers.leaveGroups(deets.Topic, simpConn)
+				simpConn.dispatcher.removeTopic(deets.Topic)
+				//send acknkowledge
+				nextData.Type = unsubAck
+				err = simpConn.respond(nextData)
+				if err != nil {
+					fmt.Println("error responding")
+				}
+				break
+			}
+		case credit:
+			{
+				deets, err := nextData.GetSubDetails()
+				if err != nil {
+					fmt.Println("theres error getting credit details simp_broker:afterAuthLoopForConn()")
+					break
+				}
+				simpConn.dispatcher.grant(deets.Topic, deets.Credits)
+				break
+			}
+		case fetch:
+			{
+				deets, err := nextData.GetFetchDetails()
+				if err != nil {
+					fmt.Println("theres error getting fetch details simp_broker:afterAuthLoopForConn()")
+					break
+				}
+				if deets.Max == 0 {
+					//nothing to wait for
+					err = simpConn.respond(&SimpData{Type: fetchEnd, ID: nextData.ID})
 					if err != nil {
 						fmt.Println("error responding")
 					}
 					break
 				}
-			case unsub:
-				{
-					deets, err := nextData.GetSubDetails()
-					if err != nil {
-						fmt.Println("theres error getting sub details simp_broker:afterAuthLoopForConn()")
-					}
-					broker.subscribers.removeForTopic(deets.Topic, simpConn)
-					//send acknkowledge
-					nextData.Type = unsubAck
-					err = simpConn.respond(nextData)
+				if !simpConn.startFetch(broker.MaxFetchesPerConnection) {
+					simpConn.respondError(nextData.ID, fmt.Errorf("at most %d fetches of a connection wait at once", broker.MaxFetchesPerConnection))
+					break
+				}
+				//fetches wait for messages, so they must not hold up the connection
+				go broker.handleFetch(simpConn, nextData.ID, deets)
+				break
+			}
+		case ack:
+			{
+				deets, err := nextData.GetFetchDetails()
+				if err != nil {
+					fmt.Println("theres error getting ack details simp_broker:afterAuthLoopForConn()")
+					break
+				}
+				ps := simpConn.namespace.subscribers.pullFor(deets.Topic, simpConn.Id, false, 0)
+				if ps != nil {
+					ps.ack(deets.Offset)
+					//losing an ack in a crash only delivers the messages again, so it is not synced
+					err = broker.writeJournal(&journalRecord{Op: journalAck, Namespace: simpConn.namespace.Name, Topic: deets.Topic, ClientID: simpConn.Id, Offset: deets.Offset}, false)
 					if err != nil {
-						fmt.Println("error responding")
+						fmt.Println("unable to store the ack", err)
 					}
+				}
+				err = simpConn.respond(&SimpData{Type: ackAck, ID: nextData.ID})
+				if err != nil {
+					fmt.Println("error responding")
+				}
+				break
+			}
+		case auth:
+			{
+				fmt.Printf("client %s is already authenticated\n", simpConn.Id)
+				break
+			}
+		case disconnect:
+			{
+				//the client drained and is closing, nothing more will come
+				return errClientDisconnected
+			}
+		}
+	}
+}
+
+//handles the publishes of the connection in the order they were read until publishes is closed,
+//publishes over the rate of the client wait here rather than in the read loop
+func (broker *SimpBroker) publishLoop(simpConn *SimpClientConn, publishes chan *SimpData, published chan struct{}) {
+	defer close(published)
+	for nextData := range publishes {
+		switch nextData.Type {
+		case pub:
+			{
+				deets, err := nextData.GetPubDetails()
+				if err != nil {
+					fmt.Println("theres error getting pub details simp_broker:publishLoop()")
+					simpConn.respondError(nextData.ID, err)
+					break
+				}
+				err = broker.authorize(simpConn, ActionPublish, deets.Topic)
+				if err != nil {
+					simpConn.respondError(nextData.ID, err)
 					break
 				}
-			case auth:
-				{
-					fmt.Printf("client %s is already authenticated\n", simpConn.Id)
+				err = broker.admitPublish(simpConn, len(deets.Data))
+				if err != nil {
+					simpConn.respondError(nextData.ID, err)
 					break
 				}
+				broker.routeMu.Lock()
+				err = broker.route(simpConn.namespace, nextData.Payload, deets)
+				broker.routeMu.Unlock()
+				if err != nil {
+					simpConn.respondError(nextData.ID, err)
+					break
+				}
+				//send acknkowledge
+				nextData.Type = pubAck
+				err = simpConn.respond(nextData)
+				if err != nil {
+					fmt.Println("error responding")
+				}
+				break
+			}
+		case batch:
+			{
+				broker.publishBatch(simpConn, nextData)
+			}
+		case txPub:
+			{
+				broker.stageTransaction(simpConn, nextData)
+				break
+			}
+		case txCommit:
+			{
+				broker.commitStaged(simpConn, nextData)
+				break
+			}
+		case txAbort:
+			{
+				simpConn.dropTransaction(nextData.ID)
+				delete(simpConn.failedTransactions, nextData.ID)
+				break
 			}
 		}
 	}
 }
 
+//ends the loop of a connection whose client said goodbye with a disconnect frame
+var errClientDisconnected = errors.New("client disconnected")
+
+//stops accepting connections and closes the connection of every client
 func (broker *SimpBroker) Close() {
 	if broker.Running {
 		close(broker.serverClosingEvent)
@@ -1,10 +1,13 @@
 package simp_broker
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -19,9 +22,33 @@ type SimpClientConn struct {
 
 	Authenticator Authenticator //authenticate connection using this callback
 
+	ScramCredentials ScramCredentialStore //credentials for SCRAM-SHA-256, the mechanism is offered when set
+
+	scramMockKey []byte //derives the salt answered for unknown clients
+
+	DisablePlainAuth bool //refuse clients sending their token as is
+
 	WaitForAuthentication time.Duration //wait window till the AuthDetails arrives after which connection fails
 
 	Id string //id
+
+	decoder *frameDecoder //reads SimpData from the connection stream
+
+	dispatcher *dispatcher //delivers published messages to this connection
+
+	transactions map[string][]*SimpData //messages of open transactions by transaction id, staged until commit
+
+	failedTransactions map[string]error //transactions refused while staging, their commit fails with the reason
+
+	stagedMessages uint //messages staged by the open transactions
+
+	stagedBytes uint //bytes staged by the open transactions
+
+	fetches chan struct{} //a slot for each fetch of the connection waiting for messages
+
+	AuthDetails *AuthDetails //details the connection authenticated with
+
+	namespace *Namespace //tenant the connection belongs to, set once authenticated
 }
 
 //stores connection to a server on client
@@ -35,6 +62,8 @@ type SimpServerConn struct {
 	AuthDetails *AuthDetails //details to authenticate with broker
 
 	Id string //id
+
+	decoder *frameDecoder //reads SimpData from the connection stream
 }
 
 //attempts to authenticate with the server using the AuthDetails
@@ -48,7 +77,7 @@ func (sc *SimpServerConn) authenticateWithBroker() (err error) {
 	if err != nil {
 		return err
 	}
-	data, err := nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	data, err := nextDataFromConnection(sc.BufferSize, sc.reader())
 	if err != nil {
 		return err
 	}
@@ -64,7 +93,15 @@ func (sc *SimpServerConn) nextDataFromConnection() (*SimpData, error) {
 	if !sc.authenticated {
 		return nil, fmt.Errorf("connection is not authenticated to read")
 	}
-	return nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	return nextDataFromConnection(sc.BufferSize, sc.reader())
+}
+
+//decoder for the data coming from the server, created on first use
+func (sc *SimpServerConn) reader() *frameDecoder {
+	if sc.decoder == nil {
+		sc.decoder = newFrameDecoder(sc.NetConn)
+	}
+	return sc.decoder
 }
 
 //fails if not authenticated, send data to server
@@ -72,7 +109,21 @@ func (sc *SimpServerConn) respond(data *SimpData) (err error) {
 	if !sc.authenticated {
 		return fmt.Errorf("connection is not authenticated to respond")
 	}
-	return respond(data, sc.NetConn)
+	return respondWithin(data, sc.NetConn, sc.BufferSize)
+}
+
+//answers a client asking for the mechanisms with the ones the broker offers, returns the authentication
+//the client sends next
+func (sc *SimpClientConn) greet() (*SimpData, error) {
+	greeting, err := (&HelloDetails{Mechanisms: sc.supportedMechanisms()}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	err = respond(&SimpData{Type: hello, Payload: greeting}, sc.NetConn)
+	if err != nil {
+		return nil, err
+	}
+	return nextDataFromConnection(sc.BufferSize, sc.reader())
 }
 
 //authenticates using provided autheticator funtion provided to the instance
@@ -85,32 +136,85 @@ func (sc *SimpClientConn) authenticateWithClient() (data *SimpData, err error) {
 		sc.WaitForAuthentication = time.Second * 16
 	}
 	sc.NetConn.SetReadDeadline(time.Now().Add(sc.WaitForAuthentication))
-	data, err = nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	data, err = nextDataFromConnection(sc.BufferSize, sc.reader())
+	if err == nil && data.Type == auth {
+		//a client may ask for the mechanisms the broker offers to pick one, clients which do not ask are
+		//never greeted so they authenticate as they always did
+		deets, derr := data.GetAuthDetails()
+		if derr == nil && deets.Mechanism == listMechanisms {
+			data, err = sc.greet()
+		}
+	}
 	var t time.Time
 	sc.NetConn.SetReadDeadline(t)
 
 	if err != nil {
 		return nil, err
 	}
-	if sc.Authenticator != nil {
-		deets, err := data.GetAuthDetails()
+	if data.Type != auth {
+		return nil, fmt.Errorf("expected authentication from the client")
+	}
+	deets, err := data.GetAuthDetails()
+	if err != nil {
+		return nil, err
+	}
+	if len(deets.ClientID) == 0 {
+		return nil, errors.New("empty string cannot be clientId")
+	}
+	//kept for the audit trail even if the authentication fails
+	sc.AuthDetails = deets
+	//only a certificate verified during the tls handshake is trusted
+	if tlsConn, ok := sc.NetConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.PeerCertificates) > 0 {
+			deets.CertSubject = state.PeerCertificates[0].Subject.String()
+			deets.CertCommonName = state.PeerCertificates[0].Subject.CommonName
+			deets.CertDNSNames = state.PeerCertificates[0].DNSNames
+		}
+	}
+	//the client asks for a mechanism, anything the broker does not offer is refused with the ones it does
+	unsupported := fmt.Errorf("authentication mechanism %q is not supported, supported mechanisms: %s",
+		deets.Mechanism, strings.Join(sc.supportedMechanisms(), ", "))
+	switch deets.Mechanism {
+	case "", MechanismPlain:
+		if sc.DisablePlainAuth {
+			return nil, unsupported
+		}
+		if sc.Authenticator == nil {
+			return nil, fmt.Errorf("simp broker Authenticator must be provided")
+		}
+		err = sc.Authenticator(deets)
 		if err != nil {
 			return nil, err
 		}
-		err = sc.Authenticator(deets)
+		//the token is not echoed back
+		data.Payload = nil
+	case MechanismScramSHA256:
+		if sc.ScramCredentials == nil {
+			return nil, unsupported
+		}
+		final, err := sc.scramWithClient(deets)
 		if err != nil {
 			return nil, err
 		}
-		if len(deets.ClientID) == 0 {
-			return nil, errors.New("empty string cannot be clientId")
-		} else {
-			sc.Id = deets.ClientID
+		data.Payload, err = final.Marshal()
+		if err != nil {
+			return nil, err
 		}
-		sc.authenticated = true
-		return data, nil
-	} else {
-		return nil, fmt.Errorf("simp broker Authenticator must be provided")
+	default:
+		return nil, unsupported
 	}
+	sc.Id = deets.ClientID
+	sc.authenticated = true
+	return data, nil
+}
+
+//decoder for the data coming from the client, created on first use
+func (sc *SimpClientConn) reader() *frameDecoder {
+	if sc.decoder == nil {
+		sc.decoder = newFrameDecoder(sc.NetConn)
+	}
+	return sc.decoder
 }
 
 //closes the connection
@@ -126,7 +230,7 @@ func (sc *SimpClientConn) nextDataFromConnection() (*SimpData, error) {
 	if !sc.authenticated {
 		return nil, fmt.Errorf("connection is not authenticated to read")
 	}
-	return nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	return nextDataFromConnection(sc.BufferSize, sc.reader())
 }
 
 //send data to the client
@@ -134,14 +238,44 @@ func (sc *SimpClientConn) respond(data *SimpData) (err error) {
 	if !sc.authenticated {
 		return fmt.Errorf("connection is not authenticated to respond")
 	}
-	return respond(data, sc.NetConn)
+	return respondWithin(data, sc.NetConn, sc.BufferSize)
+}
+
+//tells the client its request with the id was refused and why
+func (sc *SimpClientConn) respondError(id string, reason error) (err error) {
+	payload, err := (&ErrorDetails{Message: reason.Error()}).Marshal()
+	if err != nil {
+		return err
+	}
+	return sc.respond(&SimpData{Type: nack, ID: id, Payload: payload})
 }
 
+//sending a frame bigger than the maximum frame size agreed with the other side fails with this,
+//nothing is written so the connection stays usable
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
 func respond(data *SimpData, NetConn net.Conn) (err error) {
+	return respondWithin(data, NetConn, 0)
+}
+
+//size of the frame the data is sent in
+func frameSize(data *SimpData) (uint, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	return uint(len(bytes)), nil
+}
+
+//sends the data unless its frame is bigger than maxSize, any size goes when maxSize is 0
+func respondWithin(data *SimpData, NetConn net.Conn, maxSize uint) (err error) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
+	if maxSize > 0 && uint(len(bytes)) > maxSize {
+		return fmt.Errorf("%w: frame of %d bytes, maximum %d", ErrFrameTooLarge, len(bytes), maxSize)
+	}
 	_, err = NetConn.Write(bytes)
 	if err != nil {
 		return err
@@ -149,26 +283,62 @@ func respond(data *SimpData, NetConn net.Conn) (err error) {
 	return
 }
 
-func nextDataFromConnection(BufferSize uint, NetConn net.Conn) (*SimpData, error) {
-	buf := make([]byte, BufferSize)
-	readLen, err := NetConn.Read(buf[0:])
+//decodes SimpData value by value from a connection stream, the decoder only gets to read as many bytes
+//as one frame may have so a peer streaming an endless value can not make it buffer more than that
+type frameDecoder struct {
+	conn    io.Reader
+	decoder *json.Decoder
+	//bytes the decoder may still read for the current frame
+	remaining uint
+	//set once the decoder wanted more than the current frame may have
+	exceeded bool
+}
 
-	if err != nil {
-		return nil, err
+func newFrameDecoder(conn io.Reader) *frameDecoder {
+	fd := &frameDecoder{conn: conn}
+	fd.decoder = json.NewDecoder(fd)
+	return fd
+}
 
-	} else {
-		simpData := &SimpData{}
-		err = json.Unmarshal(buf[:readLen], simpData)
-		if err != nil {
-			var serr *json.SyntaxError
-			if errors.As(err, &serr) {
-				return nil, fmt.Errorf("no other clients are supported, calls to SimpBroker must be made from a SimpClient\n%s\n%s",
-					"please check https://github.com/ondbyte/simp_mq to know which languages have SimpClient implementation",
-					"if you need a SimplClient implemented in a new language, please place a feature request")
-			}
-			return nil, err
-		} else {
-			return simpData, nil
+func (fd *frameDecoder) Read(p []byte) (int, error) {
+	if fd.remaining == 0 {
+		fd.exceeded = true
+		return 0, io.EOF
+	}
+	if uint(len(p)) > fd.remaining {
+		p = p[:fd.remaining]
+	}
+	n, err := fd.conn.Read(p)
+	fd.remaining -= uint(n)
+	return n, err
+}
+
+//reads the next SimpData from the connection, tcp may split or coalesce writes so the stream is decoded
+//value by value instead of a single read per message, fails if a message is bigger than BufferSize
+//without reading more than BufferSize bytes of it
+func nextDataFromConnection(BufferSize uint, fd *frameDecoder) (*SimpData, error) {
+	//what the decoder buffered already belongs to this frame or later ones, so reading BufferSize
+	//more bytes is enough to complete any frame which is not too big
+	fd.remaining = BufferSize
+	fd.exceeded = false
+	decoder := fd.decoder
+	start := decoder.InputOffset()
+	simpData := &SimpData{}
+	err := decoder.Decode(simpData)
+	if err != nil {
+		if fd.exceeded {
+			return nil, fmt.Errorf("message exceeds the maximum message size %d", BufferSize)
+		}
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			return nil, fmt.Errorf("no other clients are supported, calls to SimpBroker must be made from a SimpClient\n%s\n%s",
+				"please check https://github.com/ondbyte/simp_mq to know which languages have SimpClient implementation",
+				"if you need a SimplClient implemented in a new language, please place a feature request")
 		}
+		return nil, err
+	}
+	if size := decoder.InputOffset() - start; uint(size) > BufferSize {
+		return nil, fmt.Errorf("message of size %d exceeds the maximum message size %d", size, BufferSize)
 	}
+	return simpData, nil
 }
@@ -0,0 +1,225 @@
+package simp_broker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//a message waiting in a subscriber's queue to be delivered
+type queuedMessage struct {
+	topic    string
+	data     *SimpData
+	priority uint
+}
+
+//queue of a topic for one subscriber, keeps a fifo for every priority level,
+//higher level is served first
+type priorityQueue struct {
+	levels [][]*queuedMessage
+	//how many times a waiting level was passed over in favour of a higher level
+	skipped []uint
+	length  int
+	//whether the subscriber controls the flow with credits, otherwise messages are sent as fast as possible
+	limited bool
+	//messages the subscriber is ready to recieve when limited
+	credits uint
+}
+
+func newPriorityQueue(levels uint) *priorityQueue {
+	return &priorityQueue{
+		levels:  make([][]*queuedMessage, levels),
+		skipped: make([]uint, levels),
+	}
+}
+
+//adds the message to the end of its level, priorities above the highest level are clamped
+func (pq *priorityQueue) push(msg *queuedMessage) {
+	level := msg.priority
+	if level >= uint(len(pq.levels)) {
+		level = uint(len(pq.levels)) - 1
+	}
+	pq.levels[level] = append(pq.levels[level], msg)
+	pq.length++
+}
+
+//takes the next message to deliver, the highest waiting level is served unless a lower level
+//has been skipped starvationLimit times, then the oldest message of the lowest such level goes first
+func (pq *priorityQueue) pop(starvationLimit uint) *queuedMessage {
+	if pq.length == 0 {
+		return nil
+	}
+	serve := -1
+	for level := range pq.levels {
+		if len(pq.levels[level]) > 0 && pq.skipped[level] >= starvationLimit {
+			serve = level
+			break
+		}
+	}
+	if serve == -1 {
+		for level := len(pq.levels) - 1; level >= 0; level-- {
+			if len(pq.levels[level]) > 0 {
+				serve = level
+				break
+			}
+		}
+	}
+	msg := pq.levels[serve][0]
+	pq.levels[serve][0] = nil
+	pq.levels[serve] = pq.levels[serve][1:]
+	pq.length--
+	pq.skipped[serve] = 0
+	for level := 0; level < serve; level++ {
+		if len(pq.levels[level]) > 0 {
+			pq.skipped[level]++
+		}
+	}
+	return msg
+}
+
+//delivers published messages to a single subscriber connection,
+//topics are served round robin and messages within a topic by priority
+type dispatcher struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	//pending messages per topic
+	queues map[string]*priorityQueue
+	//topics in the order they are served
+	order []string
+	next  int
+
+	levels          uint
+	starvationLimit uint
+	closed          bool
+	//writes the message to the subscriber
+	send func(*SimpData) error
+}
+
+func newDispatcher(levels uint, starvationLimit uint, send func(*SimpData) error) *dispatcher {
+	d := &dispatcher{
+		queues:          make(map[string]*priorityQueue),
+		levels:          levels,
+		starvationLimit: starvationLimit,
+		send:            send,
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+//queue of the topic, created if missing, must be called with the lock held
+func (d *dispatcher) queueFor(topic string) *priorityQueue {
+	queue := d.queues[topic]
+	if queue == nil {
+		queue = newPriorityQueue(d.levels)
+		d.queues[topic] = queue
+		d.order = append(d.order, topic)
+	}
+	return queue
+}
+
+//queues a message for the subscriber, non blocking
+func (d *dispatcher) enqueue(topic string, priority uint, data *SimpData) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.queueFor(topic).push(&queuedMessage{topic: topic, data: data, priority: priority})
+	d.cond.Signal()
+}
+
+//switches the topic to credit based flow control with the given prefetch,
+//only as many messages as there are credits are sent until more are granted
+func (d *dispatcher) limit(topic string, prefetch uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue := d.queueFor(topic)
+	queue.limited = true
+	queue.credits = prefetch
+	d.cond.Signal()
+}
+
+//adds credits granted by the subscriber to the topic
+func (d *dispatcher) grant(topic string, credits uint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue := d.queues[topic]
+	if queue == nil || !queue.limited {
+		return
+	}
+	queue.credits += credits
+	d.cond.Signal()
+}
+
+//drops the queue and any pending messages of the topic
+func (d *dispatcher) removeTopic(topic string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.queues[topic]; !ok {
+		return
+	}
+	delete(d.queues, topic)
+	for i, t := range d.order {
+		if t == topic {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+	if d.next >= len(d.order) {
+		d.next = 0
+	}
+}
+
+//picks the next message to deliver skipping topics out of credits, must be called with the lock held
+func (d *dispatcher) nextMessage() *queuedMessage {
+	for i := 0; i < len(d.order); i++ {
+		idx := (d.next + i) % len(d.order)
+		queue := d.queues[d.order[idx]]
+		if queue.length > 0 && (!queue.limited || queue.credits > 0) {
+			d.next = (idx + 1) % len(d.order)
+			if queue.limited {
+				queue.credits--
+			}
+			return queue.pop(d.starvationLimit)
+		}
+	}
+	return nil
+}
+
+//blocking, delivers messages until the dispatcher is closed or the subscriber fails to recieve
+func (d *dispatcher) run() {
+	for {
+		d.mu.Lock()
+		msg := d.nextMessage()
+		for msg == nil && !d.closed {
+			d.cond.Wait()
+			msg = d.nextMessage()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+		err := d.send(msg.data)
+		if errors.Is(err, ErrFrameTooLarge) {
+			//subscribed after the message was routed with a smaller limit, it never reaches the
+			//subscriber so the subscriber never grants its credit back
+			fmt.Println("dropping message too large for subscriber", err)
+			d.grant(msg.topic, 1)
+			continue
+		}
+		if err != nil {
+			fmt.Println("failed to deliver message to subscriber, dropping the dispatcher", err)
+			d.close()
+			return
+		}
+	}
+}
+
+//stops the dispatcher, pending messages are dropped
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.cond.Broadcast()
+}
@@ -0,0 +1,150 @@
+package simp_broker
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+)
+
+//subscribers sharing a subscription on a topic, each message is delivered to only one member.
+//the topic is split into partitions, every partition is owned by one member at a time so
+//messages with the same key reach the same member in the order they were published
+type consumerGroup struct {
+	name string
+	//members in the order they joined
+	members []*SimpClientConn
+	//owner of each partition, nil when the group has no members
+	owners []*SimpClientConn
+	//spreads messages without a key over the partitions
+	next uint32
+}
+
+func newConsumerGroup(name string, partitions uint) *consumerGroup {
+	return &consumerGroup{name: name, owners: make([]*SimpClientConn, partitions)}
+}
+
+//partition the message belongs to, messages without a key are spread round robin
+func (group *consumerGroup) partitionFor(key string) int {
+	if len(key) == 0 {
+		return int(atomic.AddUint32(&group.next, 1) % uint32(len(group.owners)))
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(group.owners)))
+}
+
+func (group *consumerGroup) isMember(simpConn *SimpClientConn) bool {
+	for _, member := range group.members {
+		if member == simpConn {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *consumerGroup) join(simpConn *SimpClientConn) {
+	if group.isMember(simpConn) {
+		return
+	}
+	group.members = append(group.members, simpConn)
+	group.rebalance()
+}
+
+func (group *consumerGroup) leave(simpConn *SimpClientConn) {
+	for i, member := range group.members {
+		if member == simpConn {
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			group.rebalance()
+			return
+		}
+	}
+}
+
+//sticky rebalancing, members keep the partitions they own as long as they stay within their fair share,
+//only partitions of departed members and the excess of overloaded members move
+func (group *consumerGroup) rebalance() {
+	if len(group.members) == 0 {
+		for p := range group.owners {
+			group.owners[p] = nil
+		}
+		return
+	}
+	owned := make(map[*SimpClientConn]int)
+	for _, owner := range group.owners {
+		if owner != nil && group.isMember(owner) {
+			owned[owner]++
+		}
+	}
+	//members already owning the most partitions keep the extra ones so fewer partitions move
+	byOwned := make([]*SimpClientConn, len(group.members))
+	copy(byOwned, group.members)
+	sort.SliceStable(byOwned, func(i, j int) bool {
+		return owned[byOwned[i]] > owned[byOwned[j]]
+	})
+	share := len(group.owners) / len(group.members)
+	extra := len(group.owners) % len(group.members)
+	quota := make(map[*SimpClientConn]int)
+	for i, member := range byOwned {
+		quota[member] = share
+		if i < extra {
+			quota[member]++
+		}
+	}
+	counts := make(map[*SimpClientConn]int)
+	for p, owner := range group.owners {
+		if owner == nil || !group.isMember(owner) || counts[owner] >= quota[owner] {
+			group.owners[p] = nil
+			continue
+		}
+		counts[owner]++
+	}
+	for p, owner := range group.owners {
+		if owner != nil {
+			continue
+		}
+		for _, member := range group.members {
+			if counts[member] < quota[member] {
+				group.owners[p] = member
+				counts[member]++
+				break
+			}
+		}
+	}
+}
+
+//adds the connection to the shared subscription group of the topic
+func (SubScribers *SubScribers) joinGroup(topic string, name string, partitions uint, simpConn *SimpClientConn) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	groups := SubScribers.groups[topic]
+	if groups == nil {
+		groups = make(map[string]*consumerGroup)
+		SubScribers.groups[topic] = groups
+	}
+	group := groups[name]
+	if group == nil {
+		group = newConsumerGroup(name, partitions)
+		groups[name] = group
+	}
+	group.join(simpConn)
+}
+
+//removes the connection from every group of the topic, groups left without members are dropped
+func (SubScribers *SubScribers) leaveGroups(topic string, simpConn *SimpClientConn) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	SubScribers.leaveGroupsLocked(topic, simpConn)
+}
+
+func (SubScribers *SubScribers) leaveGroupsLocked(topic string, simpConn *SimpClientConn) {
+	groups := SubScribers.groups[topic]
+	for name, group := range groups {
+		group.leave(simpConn)
+		if len(group.members) == 0 {
+			delete(groups, name)
+		}
+	}
+	if len(groups) == 0 {
+		delete(SubScribers.groups, topic)
+	}
+}
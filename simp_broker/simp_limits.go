@@ -0,0 +1,203 @@
+package simp_broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//what the broker does with a request over a client's limit
+type LimitAction int
+
+const (
+	//the request waits until the client is back under its rate, its ack is delayed and the later
+	//publishes of the connection wait behind it, so the publisher slows down
+	ThrottleOnLimit LimitAction = iota
+	//the request is refused with an error the client recieves in place of the ack
+	RejectOnLimit
+)
+
+//limits of a client id, zero values are unlimited
+type Limits struct {
+	//published messages per second, transactional messages included
+	MessagesPerSecond float64
+	//published payload bytes per second
+	BytesPerSecond float64
+	//how far a client may burst above its rates, in seconds of its rate, defaults to 1
+	BurstSeconds float64
+	//topics a client may subscribe to at once, shared and pull subscriptions included
+	MaxSubscriptions uint
+	//what happens to a request over the limits, subscriptions over MaxSubscriptions are always rejected
+	OnLimit LimitAction
+}
+
+//classic token bucket, tokens refill at rate per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burstSeconds float64) *tokenBucket {
+	burst := rate * burstSeconds
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+//whether n tokens are available, a request bigger than the burst passes when the bucket is full
+func (tb *tokenBucket) available(n float64) bool {
+	tb.refill(time.Now())
+	if n > tb.burst {
+		n = tb.burst
+	}
+	return tb.tokens >= n
+}
+
+//takes n tokens going into debt if needed, returns how long to wait until the debt is paid
+func (tb *tokenBucket) reserve(n float64) time.Duration {
+	tb.refill(time.Now())
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+//rate state is kept by client id across its connections so reconnecting does not reset it, and by the
+//limits in effect so a client whose limits change gets buckets of the new limits
+type rateKey struct {
+	clientID string
+	limits   Limits
+}
+
+//token buckets of a client id under its limits
+type clientRate struct {
+	mu       sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+//limits applying to the client, looked up in the ClientLimits and Limits of its namespace and then
+//in the broker's, nil when unlimited
+func (broker *SimpBroker) limitsFor(simpConn *SimpClientConn) *Limits {
+	ns := simpConn.namespace
+	if limits, ok := ns.ClientLimits[simpConn.Id]; ok {
+		return limits
+	}
+	if ns.Limits != nil {
+		return ns.Limits
+	}
+	if limits, ok := broker.ClientLimits[simpConn.Id]; ok {
+		return limits
+	}
+	return broker.Limits
+}
+
+func (ns *Namespace) rateFor(clientID string, limits *Limits) *clientRate {
+	ns.rateMu.Lock()
+	defer ns.rateMu.Unlock()
+	key := rateKey{clientID: clientID, limits: *limits}
+	rate := ns.rates[key]
+	if rate == nil {
+		burstSeconds := limits.BurstSeconds
+		if burstSeconds <= 0 {
+			burstSeconds = 1
+		}
+		rate = &clientRate{}
+		if limits.MessagesPerSecond > 0 {
+			rate.messages = newTokenBucket(limits.MessagesPerSecond, burstSeconds)
+		}
+		if limits.BytesPerSecond > 0 {
+			rate.bytes = newTokenBucket(limits.BytesPerSecond, burstSeconds)
+		}
+		ns.rates[key] = rate
+	}
+	return rate
+}
+
+//charges a published message of the given size to the client, blocks while the client is throttled,
+//returns an error when the message is rejected
+func (broker *SimpBroker) admitPublish(simpConn *SimpClientConn, size int) error {
+	limits := broker.limitsFor(simpConn)
+	if limits == nil || (limits.MessagesPerSecond <= 0 && limits.BytesPerSecond <= 0) {
+		return nil
+	}
+	rate := simpConn.namespace.rateFor(simpConn.Id, limits)
+	rate.mu.Lock()
+	if limits.OnLimit == RejectOnLimit {
+		defer rate.mu.Unlock()
+		if rate.messages != nil && !rate.messages.available(1) {
+			return fmt.Errorf("rate limit of %v messages per second exceeded", limits.MessagesPerSecond)
+		}
+		if rate.bytes != nil && !rate.bytes.available(float64(size)) {
+			return fmt.Errorf("rate limit of %v bytes per second exceeded", limits.BytesPerSecond)
+		}
+		if rate.messages != nil {
+			rate.messages.reserve(1)
+		}
+		if rate.bytes != nil {
+			rate.bytes.reserve(float64(size))
+		}
+		return nil
+	}
+	var wait time.Duration
+	if rate.messages != nil {
+		wait = rate.messages.reserve(1)
+	}
+	if rate.bytes != nil {
+		if w := rate.bytes.reserve(float64(size)); w > wait {
+			wait = w
+		}
+	}
+	rate.mu.Unlock()
+	time.Sleep(wait)
+	return nil
+}
+
+//checks a new subscription of the connection on the topic against its MaxSubscriptions
+func (broker *SimpBroker) admitSubscription(simpConn *SimpClientConn, topic string) error {
+	limits := broker.limitsFor(simpConn)
+	if limits == nil || limits.MaxSubscriptions == 0 {
+		return nil
+	}
+	topics := simpConn.namespace.subscribers.topicsOf(simpConn)
+	if !topics[topic] && uint(len(topics)) >= limits.MaxSubscriptions {
+		return fmt.Errorf("subscription limit of %d topics reached", limits.MaxSubscriptions)
+	}
+	return nil
+}
+
+//topics the connection is subscribed to in any way
+func (SubScribers *SubScribers) topicsOf(simpConn *SimpClientConn) map[string]bool {
+	SubScribers.mu.RLock()
+	defer SubScribers.mu.RUnlock()
+	topics := make(map[string]bool)
+	for topic, all := range SubScribers.all {
+		if all[simpConn.Id] == simpConn {
+			topics[topic] = true
+		}
+	}
+	for topic, groups := range SubScribers.groups {
+		for _, group := range groups {
+			for _, member := range group.members {
+				if member == simpConn {
+					topics[topic] = true
+				}
+			}
+		}
+	}
+	for topic, pulls := range SubScribers.pulls {
+		if pulls[simpConn.Id] != nil {
+			topics[topic] = true
+		}
+	}
+	return topics
+}
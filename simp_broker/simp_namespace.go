@@ -0,0 +1,169 @@
+package simp_broker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//an isolated tenant of the broker, also known as a virtual host. topics, subscriptions, pull backlogs,
+//client ids, acls and quotas of a namespace are invisible to every other namespace. a client lands in
+//the namespace its Authenticator sets in AuthDetails.Namespace, the default namespace is the empty name
+type Namespace struct {
+	Name string
+	//decides the requests of the namespace's clients, the broker's Authorizer is used when nil
+	Authorizer Authorizer
+	//limits of the namespace's clients, the broker's Limits are used when nil
+	Limits *Limits
+	//limits by client id within the namespace, the broker's ClientLimits are used for ids not in here
+	ClientLimits map[string]*Limits
+	//most clients of the namespace connected at once, unlimited when 0
+	MaxConnections uint
+
+	subscribers *SubScribers
+	//connections of the namespace by client id, guarded by the broker's connMu
+	connections map[string]*SimpClientConn
+	//set once RemoveNamespace took it away, guarded by the broker's connMu
+	removed bool
+	//rate state by client id and the limits in effect for it
+	rates  map[rateKey]*clientRate
+	rateMu sync.Mutex
+}
+
+func (ns *Namespace) init() {
+	ns.subscribers = &SubScribers{}
+	ns.subscribers.init()
+	ns.connections = make(map[string]*SimpClientConn)
+	ns.rates = make(map[rateKey]*clientRate)
+}
+
+//what admin tooling sees of a namespace
+type NamespaceInfo struct {
+	Name string
+	//client ids connected to the namespace
+	Clients []string
+	//topics with at least one subscription
+	Topics []string
+}
+
+//adds a namespace, clients authenticated into it can connect right away
+func (broker *SimpBroker) AddNamespace(ns *Namespace) error {
+	broker.nsMu.Lock()
+	if broker.namespaces == nil {
+		broker.namespaces = make(map[string]*Namespace)
+	}
+	if _, exists := broker.namespaces[ns.Name]; exists {
+		broker.nsMu.Unlock()
+		return fmt.Errorf("namespace %q already exists", ns.Name)
+	}
+	ns.init()
+	broker.namespaces[ns.Name] = ns
+	broker.nsMu.Unlock()
+	broker.audit(AuditAdmin, nil, &AuditEvent{Namespace: ns.Name, Reason: "namespace added"})
+	return nil
+}
+
+//removes the namespace, every client connected to it is disconnected and its subscriptions and pull
+//backlogs are dropped, the default namespace cannot be removed
+func (broker *SimpBroker) RemoveNamespace(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("the default namespace cannot be removed")
+	}
+	broker.nsMu.Lock()
+	ns := broker.namespaces[name]
+	delete(broker.namespaces, name)
+	broker.nsMu.Unlock()
+	if ns == nil {
+		return fmt.Errorf("namespace %q does not exist", name)
+	}
+	err := broker.writeJournal(&journalRecord{Op: journalDropNamespace, Namespace: name}, true)
+	if err != nil {
+		fmt.Println("unable to store the removal of the namespace", err)
+	}
+	//a client authenticating into the namespace meanwhile either registered already and is
+	//disconnected below or is refused by registerConnection
+	broker.connMu.Lock()
+	ns.removed = true
+	connections := make([]*SimpClientConn, 0, len(ns.connections))
+	for _, simpConn := range ns.connections {
+		connections = append(connections, simpConn)
+	}
+	broker.connMu.Unlock()
+	payload, _ := (&ErrorDetails{Message: fmt.Sprintf("namespace %s was removed", name)}).Marshal()
+	for _, simpConn := range connections {
+		simpConn.respond(&SimpData{Type: disconnect, Payload: payload})
+		//the read loop of the connection fails and drops it
+		simpConn.close()
+	}
+	broker.audit(AuditAdmin, nil, &AuditEvent{Namespace: name, Reason: "namespace removed"})
+	return nil
+}
+
+//lists every namespace sorted by name
+func (broker *SimpBroker) Namespaces() []*NamespaceInfo {
+	broker.nsMu.RLock()
+	all := make([]*Namespace, 0, len(broker.namespaces))
+	for _, ns := range broker.namespaces {
+		all = append(all, ns)
+	}
+	broker.nsMu.RUnlock()
+	infos := make([]*NamespaceInfo, 0, len(all))
+	for _, ns := range all {
+		info := &NamespaceInfo{Name: ns.Name, Clients: make([]string, 0), Topics: ns.subscribers.topics()}
+		broker.connMu.Lock()
+		for id := range ns.connections {
+			info.Clients = append(info.Clients, id)
+		}
+		broker.connMu.Unlock()
+		sort.Strings(info.Clients)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+//namespace the client authenticated into, created on the fly with AutoCreateNamespaces
+func (broker *SimpBroker) namespaceFor(deets *AuthDetails) (*Namespace, error) {
+	broker.nsMu.Lock()
+	defer broker.nsMu.Unlock()
+	ns := broker.namespaces[deets.Namespace]
+	if ns == nil {
+		if !broker.AutoCreateNamespaces {
+			return nil, fmt.Errorf("namespace %q does not exist", deets.Namespace)
+		}
+		ns = &Namespace{Name: deets.Namespace}
+		ns.init()
+		broker.namespaces[ns.Name] = ns
+	}
+	return ns, nil
+}
+
+//topics with at least one subscription of any kind, sorted
+func (SubScribers *SubScribers) topics() []string {
+	SubScribers.mu.RLock()
+	defer SubScribers.mu.RUnlock()
+	unique := make(map[string]bool)
+	for topic, all := range SubScribers.all {
+		if len(all) > 0 {
+			unique[topic] = true
+		}
+	}
+	for topic, groups := range SubScribers.groups {
+		if len(groups) > 0 {
+			unique[topic] = true
+		}
+	}
+	for topic, pulls := range SubScribers.pulls {
+		if len(pulls) > 0 {
+			unique[topic] = true
+		}
+	}
+	topics := make([]string, 0, len(unique))
+	for topic := range unique {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,258 @@
+package simp_broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//a message held for a pull subscription
+type pulledMessage struct {
+	offset  uint64
+	id      string
+	deets   *PubDetails
+	payload []byte
+}
+
+//durable pull subscription of a client on a topic, the broker holds published messages until the client
+//fetches them and keeps them until they are acknowledged. it outlives the connection so a worker can
+//come back later and continue after its last acknowledged offset, offsets live in the broker's memory
+//and in its journal when SimpBroker.DataDir is set
+type pullSubscription struct {
+	mu       sync.Mutex
+	topic    string
+	clientID string
+	//messages not acknowledged yet in offset order
+	messages []*pulledMessage
+	//offset of the next published message
+	nextOffset uint64
+	//every offset below this is acknowledged
+	acked uint64
+	//next offset to be fetched in the current session
+	cursor uint64
+	//closed and replaced whenever a message arrives, wakes waiting fetches
+	arrived chan bool
+	//oldest messages are dropped when more than these are held
+	maxBacklog uint
+}
+
+func newPullSubscription(topic string, clientID string, maxBacklog uint) *pullSubscription {
+	return &pullSubscription{topic: topic, clientID: clientID, arrived: make(chan bool), maxBacklog: maxBacklog}
+}
+
+//holds a published message for the subscription
+func (ps *pullSubscription) push(id string, payload []byte, deets *PubDetails) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.messages = append(ps.messages, &pulledMessage{offset: ps.nextOffset, id: id, deets: deets, payload: payload})
+	ps.nextOffset++
+	if uint(len(ps.messages)) > ps.maxBacklog {
+		dropped := ps.messages[0]
+		ps.messages = ps.messages[1:]
+		fmt.Printf("pull subscription of %s on %s is full, dropped message at offset %d\n", ps.clientID, ps.topic, dropped.offset)
+		if ps.acked <= dropped.offset {
+			ps.acked = dropped.offset + 1
+		}
+		if ps.cursor <= dropped.offset {
+			ps.cursor = dropped.offset + 1
+		}
+	}
+	close(ps.arrived)
+	ps.arrived = make(chan bool)
+}
+
+//sets the state kept in the journal
+func (ps *pullSubscription) restore(acked uint64, nextOffset uint64, messages []*pulledMessage) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.acked = acked
+	ps.cursor = acked
+	ps.nextOffset = nextOffset
+	ps.messages = messages
+}
+
+//state of the subscription as a journal record
+func (ps *pullSubscription) snapshot(namespace string) *journalRecord {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	record := &journalRecord{Op: journalPull, Namespace: namespace, Topic: ps.topic, ClientID: ps.clientID, Offset: ps.acked, NextOffset: ps.nextOffset}
+	for _, msg := range ps.messages {
+		record.Messages = append(record.Messages, &journalMessage{Offset: msg.offset, ID: msg.id, Payload: msg.payload})
+	}
+	return record
+}
+
+//starts a new session, messages fetched but not acknowledged before are delivered again
+func (ps *pullSubscription) rewind() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.cursor = ps.acked
+}
+
+//acknowledges the message at offset and every message before it
+func (ps *pullSubscription) ack(offset uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if offset+1 <= ps.acked {
+		return
+	}
+	ps.acked = offset + 1
+	if ps.cursor < ps.acked {
+		ps.cursor = ps.acked
+	}
+	i := 0
+	for i < len(ps.messages) && ps.messages[i].offset < ps.acked {
+		ps.messages[i] = nil
+		i++
+	}
+	ps.messages = ps.messages[i:]
+}
+
+//blocking, returns up to max messages after the session's cursor, waits up to maxWait for at least one
+func (ps *pullSubscription) fetch(max uint, maxWait time.Duration) []*pulledMessage {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		ps.mu.Lock()
+		fetched := make([]*pulledMessage, 0)
+		for _, msg := range ps.messages {
+			if uint(len(fetched)) >= max {
+				break
+			}
+			if msg.offset >= ps.cursor {
+				fetched = append(fetched, msg)
+			}
+		}
+		if len(fetched) > 0 {
+			ps.cursor = fetched[len(fetched)-1].offset + 1
+			ps.mu.Unlock()
+			return fetched
+		}
+		arrived := ps.arrived
+		ps.mu.Unlock()
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return fetched
+		}
+	}
+}
+
+//pull subscription of the client on the topic, created when create is set
+func (SubScribers *SubScribers) pullFor(topic string, clientID string, create bool, maxBacklog uint) *pullSubscription {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	pulls := SubScribers.pulls[topic]
+	if pulls == nil {
+		if !create {
+			return nil
+		}
+		pulls = make(map[string]*pullSubscription)
+		SubScribers.pulls[topic] = pulls
+	}
+	ps := pulls[clientID]
+	if ps == nil && create {
+		ps = newPullSubscription(topic, clientID, maxBacklog)
+		pulls[clientID] = ps
+	}
+	return ps
+}
+
+//deletes the pull subscription and the messages it holds
+func (SubScribers *SubScribers) removePull(topic string, clientID string) {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	delete(SubScribers.pulls[topic], clientID)
+	if len(SubScribers.pulls[topic]) == 0 {
+		delete(SubScribers.pulls, topic)
+	}
+}
+
+//pull subscription of the connection's client on the topic, created and journaled if missing
+func (broker *SimpBroker) openPull(simpConn *SimpClientConn, topic string) *pullSubscription {
+	//nothing is routed while it is created so the journal sees it in the same order as the messages
+	broker.routeMu.Lock()
+	defer broker.routeMu.Unlock()
+	subscribers := simpConn.namespace.subscribers
+	ps := subscribers.pullFor(topic, simpConn.Id, false, 0)
+	if ps == nil {
+		ps = subscribers.pullFor(topic, simpConn.Id, true, broker.MaxPullBacklog)
+		err := broker.writeJournal(&journalRecord{Op: journalPull, Namespace: simpConn.namespace.Name, Topic: topic, ClientID: simpConn.Id}, true)
+		if err != nil {
+			fmt.Println("unable to store the pull subscription", err)
+		}
+	}
+	return ps
+}
+
+//deletes the pull subscription of the connection's client on the topic and the messages it holds
+func (broker *SimpBroker) closePull(simpConn *SimpClientConn, topic string) {
+	broker.routeMu.Lock()
+	defer broker.routeMu.Unlock()
+	simpConn.namespace.subscribers.removePull(topic, simpConn.Id)
+	err := broker.writeJournal(&journalRecord{Op: journalUnpull, Namespace: simpConn.namespace.Name, Topic: topic, ClientID: simpConn.Id}, true)
+	if err != nil {
+		fmt.Println("unable to store the removal of the pull subscription", err)
+	}
+}
+
+//snapshot of the pull subscriptions of the topic
+func (SubScribers *SubScribers) pullsForTopic(topic string) []*pullSubscription {
+	SubScribers.mu.RLock()
+	defer SubScribers.mu.RUnlock()
+	all := make([]*pullSubscription, 0, len(SubScribers.pulls[topic]))
+	for _, ps := range SubScribers.pulls[topic] {
+		all = append(all, ps)
+	}
+	return all
+}
+
+//takes a slot for a waiting fetch, false when max fetches of the connection wait already,
+//called from the read loop only
+func (simpConn *SimpClientConn) startFetch(max uint) bool {
+	if simpConn.fetches == nil {
+		simpConn.fetches = make(chan struct{}, max)
+	}
+	select {
+	case simpConn.fetches <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+//frees the slot of a finished fetch
+func (simpConn *SimpClientConn) endFetch() {
+	<-simpConn.fetches
+}
+
+//answers a fetch request of the connection, every message is sent as its own frame
+//followed by a fetchEnd frame, all carrying the id of the request
+func (broker *SimpBroker) handleFetch(simpConn *SimpClientConn, id string, deets *FetchDetails) {
+	defer simpConn.endFetch()
+	ps := simpConn.namespace.subscribers.pullFor(deets.Topic, simpConn.Id, false, 0)
+	if ps != nil {
+		maxWait := time.Duration(deets.MaxWait) * time.Millisecond
+		if maxWait > broker.MaxFetchWait {
+			maxWait = broker.MaxFetchWait
+		}
+		for _, msg := range ps.fetch(deets.Max, maxWait) {
+			fetched := *msg.deets
+			fetched.Offset = msg.offset
+			payload, err := fetched.Marshal()
+			if err != nil {
+				fmt.Println("theres error marshalling fetched message simp_broker:handleFetch()")
+				continue
+			}
+			err = simpConn.respond(&SimpData{Type: fetchMsg, ID: id, Payload: payload})
+			if err != nil {
+				fmt.Println("error responding")
+				return
+			}
+		}
+	}
+	err := simpConn.respond(&SimpData{Type: fetchEnd, ID: id})
+	if err != nil {
+		fmt.Println("error responding")
+	}
+}
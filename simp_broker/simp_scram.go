@@ -0,0 +1,148 @@
+package simp_broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//what the broker stores to verify a client with SCRAM-SHA-256, the secret itself is never stored
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+	//roles handed to the Authorizer once the client is verified
+	Roles []string
+	//namespace the client is put in once verified
+	Namespace string
+}
+
+//looks up the SCRAM credential of a client, return an error for unknown clients
+type ScramCredentialStore func(clientID string) (*ScramCredential, error)
+
+//fewest iterations a credential is derived with, clients refuse challenges with less
+const minScramIterations = 4096
+
+//derives the SCRAM credential of a secret with a random salt, 4096 iterations are used when iterations is 0
+func NewScramCredential(secret string, iterations int) (*ScramCredential, error) {
+	if iterations == 0 {
+		iterations = minScramIterations
+	}
+	if iterations < minScramIterations {
+		return nil, fmt.Errorf("at least %d iterations are required, got %d", minScramIterations, iterations)
+	}
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	salted := pbkdf2.Key([]byte(secret), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+//what both sides sign, binds the proof to the client, both nonces and the salt
+func scramAuthMessage(clientID string, clientNonce string, nonce string, salt []byte, iterations int) string {
+	return strings.Join([]string{clientID, clientNonce, nonce, base64.StdEncoding.EncodeToString(salt), fmt.Sprint(iterations)}, ",")
+}
+
+//credential an unknown client is challenged with, the salt is the same for every attempt with the id so
+//the challenge looks like the one of a known client and the exchange fails at the proof like a wrong secret,
+//no proof matches its stored key
+func (sc *SimpClientConn) mockScramCredential(clientID string) *ScramCredential {
+	return &ScramCredential{
+		Salt:       scramHMAC(sc.scramMockKey, clientID)[:16],
+		Iterations: minScramIterations,
+		StoredKey:  make([]byte, sha256.Size),
+		ServerKey:  make([]byte, sha256.Size),
+	}
+}
+
+//mechanisms the connection accepts, the broker's preference first, the client is greeted with them
+func (sc *SimpClientConn) supportedMechanisms() []string {
+	mechanisms := make([]string, 0, 2)
+	if sc.ScramCredentials != nil {
+		mechanisms = append(mechanisms, MechanismScramSHA256)
+	}
+	if !sc.DisablePlainAuth {
+		mechanisms = append(mechanisms, MechanismPlain)
+	}
+	return mechanisms
+}
+
+//runs the SCRAM-SHA-256 exchange after the client's first message, the broker challenges the client with
+//a nonce, salt and iteration count and the client proves it knows the secret without sending it.
+//returns the server signature the client uses to verify the broker in turn
+func (sc *SimpClientConn) scramWithClient(deets *AuthDetails) (*ScramDetails, error) {
+	credential, err := sc.ScramCredentials(deets.ClientID)
+	if err != nil || credential == nil {
+		credential = sc.mockScramCredential(deets.ClientID)
+	}
+	if len(deets.Nonce) == 0 {
+		return nil, errors.New("client nonce is required for " + MechanismScramSHA256)
+	}
+	serverNonce := make([]byte, 18)
+	_, err = rand.Read(serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	nonce := deets.Nonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	challenge, err := (&ScramDetails{Nonce: nonce, Salt: credential.Salt, Iterations: credential.Iterations}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	err = respond(&SimpData{Type: authChallenge, Payload: challenge}, sc.NetConn)
+	if err != nil {
+		return nil, err
+	}
+	sc.NetConn.SetReadDeadline(time.Now().Add(sc.WaitForAuthentication))
+	data, err := nextDataFromConnection(sc.BufferSize, sc.reader())
+	var t time.Time
+	sc.NetConn.SetReadDeadline(t)
+	if err != nil {
+		return nil, err
+	}
+	if data.Type != authProof {
+		return nil, errors.New("expected the client's proof")
+	}
+	proof, err := data.GetScramDetails()
+	if err != nil {
+		return nil, err
+	}
+	if proof.Nonce != nonce || len(proof.Proof) != sha256.Size {
+		return nil, errors.New("failed to authenticate")
+	}
+	authMessage := scramAuthMessage(deets.ClientID, deets.Nonce, nonce, credential.Salt, credential.Iterations)
+	signature := scramHMAC(credential.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof.Proof[i] ^ signature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], credential.StoredKey) {
+		return nil, errors.New("failed to authenticate")
+	}
+	deets.Roles = credential.Roles
+	deets.Namespace = credential.Namespace
+	return &ScramDetails{ServerSignature: scramHMAC(credential.ServerKey, authMessage)}, nil
+}
@@ -0,0 +1,147 @@
+package simp_broker
+
+import (
+	"fmt"
+)
+
+//what the broker does when a client authenticates with the id of a client which is still connected
+type ConflictPolicy int
+
+const (
+	//the old connection is dropped and the new one takes over its subscriptions, shared subscription
+	//memberships and undelivered messages, the old client is told why it was disconnected
+	TakeOverSession ConflictPolicy = iota
+	//the new connection is refused, the old one stays
+	RejectNewcomer
+)
+
+//registers the authenticated connection under its client id in its namespace, resolving a conflict with a connection
+//already registered under the id according to the ClientIDConflict policy. transactions the old
+//connection staged but did not commit are not taken over, pull subscriptions belong to the client id anyway
+func (broker *SimpBroker) registerConnection(simpConn *SimpClientConn) (*SessionDetails, error) {
+	ns, err := broker.namespaceFor(simpConn.AuthDetails)
+	if err != nil {
+		return nil, err
+	}
+	//the audit sink and the old connection are only called once connMu is released
+	broker.connMu.Lock()
+	if ns.removed {
+		broker.connMu.Unlock()
+		return nil, fmt.Errorf("namespace %q was removed", ns.Name)
+	}
+	simpConn.namespace = ns
+	old := ns.connections[simpConn.Id]
+	if old == nil {
+		if broker.MaxConnections > 0 && broker.connectionCount >= broker.MaxConnections {
+			broker.connMu.Unlock()
+			return nil, fmt.Errorf("broker reached its limit of %d connections", broker.MaxConnections)
+		}
+		if ns.MaxConnections > 0 && uint(len(ns.connections)) >= ns.MaxConnections {
+			broker.connMu.Unlock()
+			return nil, fmt.Errorf("namespace reached its limit of %d connections", ns.MaxConnections)
+		}
+		ns.connections[simpConn.Id] = simpConn
+		broker.connectionCount++
+		broker.connMu.Unlock()
+		return &SessionDetails{}, nil
+	}
+	if broker.ClientIDConflict == RejectNewcomer {
+		broker.connMu.Unlock()
+		//the connected client learns someone else authenticated with its id
+		payload, _ := (&ErrorDetails{Message: fmt.Sprintf("a connection from %s tried to take over the session and was refused", simpConn.NetConn.RemoteAddr())}).Marshal()
+		old.respond(&SimpData{Type: takeoverRefused, Payload: payload})
+		fmt.Printf("refused client %s, its id is already connected\n", simpConn.Id)
+		broker.audit(AuditSessionRejected, simpConn, &AuditEvent{Reason: fmt.Sprintf("client id is already connected from %s", old.NetConn.RemoteAddr())})
+		return nil, fmt.Errorf("client id %s is already connected", simpConn.Id)
+	}
+	ns.connections[simpConn.Id] = simpConn
+	//nothing is routed to the old connection while its session moves
+	broker.routeMu.Lock()
+	topics := ns.subscribers.migrate(old, simpConn)
+	old.dispatcher.handOver(simpConn.dispatcher)
+	broker.routeMu.Unlock()
+	broker.connMu.Unlock()
+	payload, _ := (&ErrorDetails{Message: fmt.Sprintf("session taken over by a new connection from %s", simpConn.NetConn.RemoteAddr())}).Marshal()
+	old.respond(&SimpData{Type: disconnect, Payload: payload})
+	old.close()
+	fmt.Printf("client %s took over the session of its earlier connection\n", simpConn.Id)
+	broker.audit(AuditSessionTakeover, simpConn, &AuditEvent{Reason: fmt.Sprintf("took over the session of the connection from %s", old.NetConn.RemoteAddr())})
+	return &SessionDetails{TookOver: true, Topics: topics}, nil
+}
+
+//forgets the connection if it is still the one registered under its id
+func (broker *SimpBroker) unregisterConnection(simpConn *SimpClientConn) {
+	broker.connMu.Lock()
+	defer broker.connMu.Unlock()
+	ns := simpConn.namespace
+	if ns != nil && ns.connections[simpConn.Id] == simpConn {
+		delete(ns.connections, simpConn.Id)
+		broker.connectionCount--
+	}
+}
+
+//moves every subscription and group membership of the old connection to the new one,
+//returns the topics moved
+func (SubScribers *SubScribers) migrate(old *SimpClientConn, replacement *SimpClientConn) []string {
+	SubScribers.mu.Lock()
+	defer SubScribers.mu.Unlock()
+	topics := make([]string, 0)
+	for topic, all := range SubScribers.all {
+		if all[old.Id] == old {
+			all[replacement.Id] = replacement
+			topics = append(topics, topic)
+		}
+	}
+	for topic, groups := range SubScribers.groups {
+		for _, group := range groups {
+			moved := false
+			for i, member := range group.members {
+				if member == old {
+					group.members[i] = replacement
+					moved = true
+				}
+			}
+			for p, owner := range group.owners {
+				if owner == old {
+					group.owners[p] = replacement
+				}
+			}
+			if moved {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics
+}
+
+//moves the pending messages and credits of every topic to the other dispatcher and stops this one
+func (d *dispatcher) handOver(to *dispatcher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	for _, topic := range d.order {
+		if _, exists := to.queues[topic]; !exists {
+			to.queues[topic] = d.queues[topic]
+			to.order = append(to.order, topic)
+		}
+	}
+	d.queues = make(map[string]*priorityQueue)
+	d.order = nil
+	d.closed = true
+	d.cond.Broadcast()
+	to.cond.Signal()
+}
+
+//closes the connection of every client, their read loops drop them
+func (broker *SimpBroker) closeAllConnections() {
+	broker.nsMu.RLock()
+	defer broker.nsMu.RUnlock()
+	broker.connMu.Lock()
+	defer broker.connMu.Unlock()
+	for _, ns := range broker.namespaces {
+		for _, simpConn := range ns.connections {
+			simpConn.close()
+		}
+	}
+}
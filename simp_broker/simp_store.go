@@ -0,0 +1,305 @@
+package simp_broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	//a pull subscription was created, or its whole state when the journal is compacted
+	journalPull = "pull"
+	//a pull subscription was removed
+	journalUnpull = "unpull"
+	//messages routed together, a single publish or a committed transaction
+	journalPub = "pub"
+	//a pull subscription acknowledged an offset
+	journalAck = "ack"
+	//a namespace was removed with its pull subscriptions
+	journalDropNamespace = "dropns"
+)
+
+//one line of the journal
+type journalRecord struct {
+	Op        string `json:"op"`
+	Namespace string `json:"ns,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	ClientID  string `json:"clientId,omitempty"`
+	//acknowledged offset, every offset below the one of a compacted pull subscription
+	Offset uint64 `json:"offset,omitempty"`
+	//next offset of a compacted pull subscription
+	NextOffset uint64            `json:"nextOffset,omitempty"`
+	Messages   []*journalMessage `json:"messages,omitempty"`
+}
+
+type journalMessage struct {
+	//topic of a routed message
+	Topic string `json:"topic,omitempty"`
+	//offset of a message held by a compacted pull subscription
+	Offset  uint64 `json:"offset,omitempty"`
+	ID      string `json:"id"`
+	Payload []byte `json:"payload"`
+}
+
+//append only log of everything that changes the pull subscriptions, replayed when the broker starts
+//and compacted to the current state right after and whenever it grows past the MaxJournalSize. each
+//record is one line written at once, the last record torn by a crash does not parse and is left out,
+//so routed messages survive together or not at all
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+	//bytes in the file
+	size int64
+	//the journal is compacted once it grows past this
+	limit int64
+	//set while a compaction is under way
+	compacting bool
+}
+
+//appends the record, with sync set it is on disk before this returns
+func (j *journal) write(record *journalRecord, sync bool) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	n, err := j.file.Write(append(bytes, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+//whether the journal grew past its limit and nobody compacts it yet, the caller must compact it then
+func (j *journal) needsCompaction() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil || j.compacting || j.size < j.limit {
+		return false
+	}
+	j.compacting = true
+	return true
+}
+
+//writes the record to the journal if the broker keeps one
+func (broker *SimpBroker) writeJournal(record *journalRecord, sync bool) error {
+	if broker.store == nil {
+		return nil
+	}
+	err := broker.store.write(record, sync)
+	if err == nil && broker.store.needsCompaction() {
+		//writers may hold the routeMu the compaction needs
+		go broker.compactJournal()
+	}
+	return err
+}
+
+//replaces the journal with the current state while it is running, nothing is routed and nothing is
+//written to the journal meanwhile so no record is lost between the snapshot and the new file
+func (broker *SimpBroker) compactJournal() {
+	broker.routeMu.Lock()
+	defer broker.routeMu.Unlock()
+	j := broker.store
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.compacting = false
+	if j.file == nil {
+		return
+	}
+	err := broker.compact(j.path)
+	if err != nil {
+		fmt.Println("unable to compact the journal", err)
+		return
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fmt.Println("unable to reopen the compacted journal", err)
+		return
+	}
+	j.file.Close()
+	j.file = file
+	j.size = fileSize(file)
+}
+
+func fileSize(file *os.File) int64 {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+//restores the pull subscriptions from the journal in the DataDir and compacts it, namespaces the
+//journal names must be added before Serve unless AutoCreateNamespaces is set, their records are dropped
+func (broker *SimpBroker) openStore() error {
+	err := os.MkdirAll(broker.DataDir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(broker.DataDir, "journal")
+	file, err := os.Open(path)
+	if err == nil {
+		err = broker.replay(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err = broker.compact(path)
+	if err != nil {
+		return err
+	}
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	broker.store = &journal{file: file, path: path, size: fileSize(file), limit: int64(broker.MaxJournalSize)}
+	return nil
+}
+
+func (broker *SimpBroker) replay(file io.Reader) error {
+	reader := bufio.NewReader(file)
+	records := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println("dropping the torn last record of the journal")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &journalRecord{}
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			//only the last record can be torn by a crash, anything before it was acknowledged
+			_, next := reader.Peek(1)
+			if next == io.EOF {
+				fmt.Println("dropping the torn last record of the journal")
+				return nil
+			}
+			return fmt.Errorf("journal is corrupt at record %d: %w", records+1, err)
+		}
+		records++
+		broker.apply(record)
+	}
+}
+
+//namespace of a journal record, nil if it is gone
+func (broker *SimpBroker) storedNamespace(name string) *Namespace {
+	ns, err := broker.namespaceFor(&AuthDetails{Namespace: name})
+	if err != nil {
+		return nil
+	}
+	return ns
+}
+
+func (broker *SimpBroker) apply(record *journalRecord) {
+	ns := broker.storedNamespace(record.Namespace)
+	if ns == nil {
+		return
+	}
+	switch record.Op {
+	case journalPull:
+		ps := ns.subscribers.pullFor(record.Topic, record.ClientID, true, broker.MaxPullBacklog)
+		messages := make([]*pulledMessage, 0, len(record.Messages))
+		for _, msg := range record.Messages {
+			deets, err := storedPubDetails(msg)
+			if err != nil {
+				continue
+			}
+			messages = append(messages, &pulledMessage{offset: msg.Offset, id: msg.ID, deets: deets, payload: msg.Payload})
+		}
+		ps.restore(record.Offset, record.NextOffset, messages)
+	case journalUnpull:
+		ns.subscribers.removePull(record.Topic, record.ClientID)
+	case journalPub:
+		for _, msg := range record.Messages {
+			deets, err := storedPubDetails(msg)
+			if err != nil {
+				continue
+			}
+			for _, ps := range ns.subscribers.pullsForTopic(msg.Topic) {
+				ps.push(msg.ID, msg.Payload, deets)
+			}
+		}
+	case journalAck:
+		ps := ns.subscribers.pullFor(record.Topic, record.ClientID, false, 0)
+		if ps != nil {
+			ps.ack(record.Offset)
+		}
+	case journalDropNamespace:
+		ns.subscribers.mu.Lock()
+		ns.subscribers.pulls = make(map[string]map[string]*pullSubscription)
+		ns.subscribers.mu.Unlock()
+	}
+}
+
+func storedPubDetails(msg *journalMessage) (*PubDetails, error) {
+	deets := &PubDetails{}
+	err := json.Unmarshal(msg.Payload, deets)
+	if err != nil {
+		fmt.Println("dropping unreadable message from the journal", err)
+		return nil, err
+	}
+	return deets, nil
+}
+
+//replaces the journal with one record per pull subscription holding its current state
+func (broker *SimpBroker) compact(path string) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	broker.nsMu.RLock()
+	for _, ns := range broker.namespaces {
+		ns.subscribers.mu.RLock()
+		for _, pulls := range ns.subscribers.pulls {
+			for _, ps := range pulls {
+				bytes, err := json.Marshal(ps.snapshot(ns.Name))
+				if err == nil {
+					writer.Write(append(bytes, '\n'))
+				}
+			}
+		}
+		ns.subscribers.mu.RUnlock()
+	}
+	broker.nsMu.RUnlock()
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,75 @@
+package simp_broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+//builds a tls config for SimpBroker.TLSConfig from pem files, caFile is the pool client certificates are
+//verified against, with verifyClients set every client must present a certificate signed by it (mutual tls),
+//the subject of the verified certificate is then passed to the Authenticator in AuthDetails.CertSubject
+func LoadTLSConfig(certFile string, keyFile string, caFile string, verifyClients bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+	}
+	if verifyClients {
+		if config.ClientCAs == nil {
+			return nil, fmt.Errorf("a CA file is required to verify client certificates")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+//looks up the roles and namespace of a client its certificate vouched for, return an error to refuse the client
+type CertIdentities func(clientID string) (roles []string, namespace string, err error)
+
+//Authenticator accepting a client whose verified certificate is issued to its client id, by the common name or
+//a dns subject alternative name, any other client, with a certificate for another id or none, is passed to next.
+//a certificate alone never lets a client pick someone else's id. the roles and namespace of an accepted client
+//come from identities, without identities it has no roles and is put in the default namespace
+func CertAuthenticator(identities CertIdentities, next Authenticator) Authenticator {
+	return func(deets *AuthDetails) error {
+		if len(deets.CertSubject) > 0 && certIssuedTo(deets, deets.ClientID) {
+			if identities == nil {
+				return nil
+			}
+			roles, namespace, err := identities(deets.ClientID)
+			if err != nil {
+				return err
+			}
+			deets.Roles = roles
+			deets.Namespace = namespace
+			return nil
+		}
+		return next(deets)
+	}
+}
+
+//whether the verified certificate names the client id
+func certIssuedTo(deets *AuthDetails, clientID string) bool {
+	if deets.CertCommonName == clientID {
+		return true
+	}
+	for _, name := range deets.CertDNSNames {
+		if name == clientID {
+			return true
+		}
+	}
+	return false
+}
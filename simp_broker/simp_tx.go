@@ -0,0 +1,82 @@
+package simp_broker
+
+import (
+	"fmt"
+)
+
+//stages a message of a transaction on the connection, nothing is visible to subscribers until the commit.
+//a message refused by the acl, the rate limit or the staging limits fails the whole transaction,
+//what it staged so far is dropped right away
+func (broker *SimpBroker) stageTransaction(simpConn *SimpClientConn, data *SimpData) {
+	if simpConn.transactions == nil {
+		simpConn.transactions = make(map[string][]*SimpData)
+		simpConn.failedTransactions = make(map[string]error)
+	}
+	if simpConn.failedTransactions[data.ID] != nil {
+		return
+	}
+	deets, err := data.GetPubDetails()
+	if err == nil {
+		err = broker.authorize(simpConn, ActionPublish, deets.Topic)
+	}
+	if err == nil && simpConn.stagedMessages+1 > broker.MaxStagedMessages {
+		err = fmt.Errorf("transactions of the connection stage more than %d messages", broker.MaxStagedMessages)
+	}
+	if err == nil && simpConn.stagedBytes+uint(len(data.Payload)) > broker.MaxStagedBytes {
+		err = fmt.Errorf("transactions of the connection stage more than %d bytes", broker.MaxStagedBytes)
+	}
+	if err == nil {
+		//staged messages count against the rate limits like any other publish
+		err = broker.admitPublish(simpConn, len(deets.Data))
+	}
+	if err != nil {
+		simpConn.dropTransaction(data.ID)
+		simpConn.failedTransactions[data.ID] = err
+		return
+	}
+	simpConn.transactions[data.ID] = append(simpConn.transactions[data.ID], data)
+	simpConn.stagedMessages++
+	simpConn.stagedBytes += uint(len(data.Payload))
+}
+
+//routes the staged messages of the transaction at once if the broker staged as many as the client sent,
+//a transaction the connection does not know, for one staged on an earlier connection, is refused
+func (broker *SimpBroker) commitStaged(simpConn *SimpClientConn, data *SimpData) {
+	staged, known := simpConn.transactions[data.ID]
+	failed := simpConn.failedTransactions[data.ID]
+	simpConn.dropTransaction(data.ID)
+	delete(simpConn.failedTransactions, data.ID)
+	if failed != nil {
+		simpConn.respondError(data.ID, failed)
+		return
+	}
+	if !known {
+		simpConn.respondError(data.ID, fmt.Errorf("transaction %s is unknown, nothing was staged for it on this connection", data.ID))
+		return
+	}
+	deets, err := data.GetTxDetails()
+	if err == nil && deets.Staged != uint(len(staged)) {
+		err = fmt.Errorf("transaction %s has %d of its %d messages staged, it was not committed", data.ID, len(staged), deets.Staged)
+	}
+	if err == nil {
+		err = broker.commitTransaction(simpConn.namespace, staged)
+	}
+	if err != nil {
+		simpConn.respondError(data.ID, err)
+		return
+	}
+	//single acknkowledge for the whole transaction
+	err = simpConn.respond(&SimpData{Type: txAck, ID: data.ID})
+	if err != nil {
+		fmt.Println("error responding")
+	}
+}
+
+//forgets the staged messages of the transaction
+func (simpConn *SimpClientConn) dropTransaction(id string) {
+	for _, data := range simpConn.transactions[id] {
+		simpConn.stagedMessages--
+		simpConn.stagedBytes -= uint(len(data.Payload))
+	}
+	delete(simpConn.transactions, id)
+}
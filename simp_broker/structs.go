@@ -32,6 +32,34 @@ func (r *SimpData) GetPubDetails() (*PubDetails, error) {
 	return UnmarshalPubDetails(r.Payload)
 }
 
+func (r *SimpData) GetFetchDetails() (*FetchDetails, error) {
+	return UnmarshalFetchDetails(r.Payload)
+}
+
+func (r *SimpData) GetErrorDetails() (*ErrorDetails, error) {
+	return UnmarshalErrorDetails(r.Payload)
+}
+
+func (r *SimpData) GetScramDetails() (*ScramDetails, error) {
+	return UnmarshalScramDetails(r.Payload)
+}
+
+func (r *SimpData) GetHelloDetails() (*HelloDetails, error) {
+	return UnmarshalHelloDetails(r.Payload)
+}
+
+func (r *SimpData) GetSessionDetails() (*SessionDetails, error) {
+	return UnmarshalSessionDetails(r.Payload)
+}
+
+func (r *SimpData) GetBatchDetails() (*BatchDetails, error) {
+	return UnmarshalBatchDetails(r.Payload)
+}
+
+func (r *SimpData) GetTxDetails() (*TxDetails, error) {
+	return UnmarshalTxDetails(r.Payload)
+}
+
 type SimpData struct {
 	Type    MessagType `json:"type,omitempty"`
 	ID      string     `json:"id,omitempty"`
@@ -51,6 +79,22 @@ func (r *AuthDetails) Marshal() ([]byte, error) {
 type AuthDetails struct {
 	Token    string `json:"token,omitempty"`
 	ClientID string `json:"clientId,omitempty"`
+	//authentication mechanism the client asks for, MechanismPlain when empty
+	Mechanism string `json:"mechanism,omitempty"`
+	//client nonce of a challenge-response mechanism
+	Nonce string `json:"nonce,omitempty"`
+	//subject of the client certificate verified by the broker over mutual tls, never sent by the client
+	CertSubject string `json:"-"`
+	//common name of the verified client certificate
+	CertCommonName string `json:"-"`
+	//dns subject alternative names of the verified client certificate
+	CertDNSNames []string `json:"-"`
+	//roles of the client used to authorize its requests, set by the Authenticator, never sent by the client
+	Roles []string `json:"-"`
+	//namespace the client belongs to, set by the Authenticator, the default namespace when empty
+	Namespace string `json:"-"`
+	//largest frame the client wants to send and recieve, the broker answers with the size both agree on
+	MaxFrameSize uint `json:"maxFrameSize,omitempty"`
 }
 
 type MessagType int
@@ -64,6 +108,34 @@ const (
 	authAck
 	unsub
 	unsubAck
+	txPub
+	txCommit
+	txAbort
+	txAck
+	credit
+	fetch
+	fetchMsg
+	fetchEnd
+	ack
+	ackAck
+	nack
+	authChallenge
+	authProof
+	session
+	disconnect
+	batch
+	batchAck
+	hello
+	takeoverRefused
+)
+
+const (
+	//the client sends its token as is
+	MechanismPlain = "PLAIN"
+	//the client proves it knows the token without sending it
+	MechanismScramSHA256 = "SCRAM-SHA-256"
+	//asks the broker for the mechanisms it offers before authenticating, answered with a hello
+	listMechanisms = "LIST"
 )
 
 func UnmarshalSubDetails(data []byte) (*SubDetails, error) {
@@ -77,7 +149,10 @@ func (r *SubDetails) Marshal() ([]byte, error) {
 }
 
 type SubDetails struct {
-	Topic string `json:"topic,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Group   string `json:"group,omitempty"`
+	Credits uint   `json:"credits,omitempty"`
+	Pull    bool   `json:"pull,omitempty"`
 }
 
 func UnmarshalPubDetails(data []byte) (*PubDetails, error) {
@@ -91,8 +166,136 @@ func (r *PubDetails) Marshal() ([]byte, error) {
 }
 
 type PubDetails struct {
-	Topic string `json:"topic,omitempty"`
-	Data  []byte `json:"data,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Priority uint   `json:"priority,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Offset   uint64 `json:"offset,omitempty"`
+	//metadata of the message, forwarded by the broker untouched
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func UnmarshalFetchDetails(data []byte) (*FetchDetails, error) {
+	r := &FetchDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *FetchDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+type FetchDetails struct {
+	Topic   string `json:"topic,omitempty"`
+	Max     uint   `json:"max,omitempty"`
+	MaxWait int64  `json:"maxWait,omitempty"`
+	Offset  uint64 `json:"offset,omitempty"`
 }
 
 type Authenticator func(*AuthDetails) error
+
+func UnmarshalErrorDetails(data []byte) (*ErrorDetails, error) {
+	r := &ErrorDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *ErrorDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//reason the broker refused a request, sent in a nack with the id of the request
+type ErrorDetails struct {
+	Message string `json:"message,omitempty"`
+}
+
+func UnmarshalScramDetails(data []byte) (*ScramDetails, error) {
+	r := &ScramDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *ScramDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//messages of the SCRAM-SHA-256 exchange, the broker's challenge, the client's proof and the broker's signature
+type ScramDetails struct {
+	Nonce           string `json:"nonce,omitempty"`
+	Salt            []byte `json:"salt,omitempty"`
+	Iterations      int    `json:"iterations,omitempty"`
+	Proof           []byte `json:"proof,omitempty"`
+	ServerSignature []byte `json:"serverSignature,omitempty"`
+}
+
+func UnmarshalHelloDetails(data []byte) (*HelloDetails, error) {
+	r := &HelloDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *HelloDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//what the broker greets a new connection with before the client authenticates
+type HelloDetails struct {
+	//authentication mechanisms the broker offers, the one it prefers first
+	Mechanisms []string `json:"mechanisms,omitempty"`
+}
+
+func UnmarshalSessionDetails(data []byte) (*SessionDetails, error) {
+	r := &SessionDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *SessionDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//sent right after the authAck, tells the client whether it took over the session of an earlier
+//connection with the same client id and which topics it inherited
+type SessionDetails struct {
+	TookOver bool     `json:"tookOver,omitempty"`
+	Topics   []string `json:"topics,omitempty"`
+	//largest frame either side sends or accepts on the connection
+	MaxFrameSize uint `json:"maxFrameSize,omitempty"`
+}
+
+func UnmarshalBatchDetails(data []byte) (*BatchDetails, error) {
+	r := &BatchDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *BatchDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//several publishes in one frame, the batchAck of the frame lists the publishes which failed with their reason
+type BatchDetails struct {
+	Messages []*BatchMessage   `json:"messages,omitempty"`
+	Failed   map[string]string `json:"failed,omitempty"`
+}
+
+type BatchMessage struct {
+	ID  string      `json:"id,omitempty"`
+	Pub *PubDetails `json:"pub,omitempty"`
+}
+
+func UnmarshalTxDetails(data []byte) (*TxDetails, error) {
+	r := &TxDetails{}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+func (r *TxDetails) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//sent with the commit of a transaction, the broker refuses the commit when it did not stage
+//the same number of messages, so nothing is committed after messages were lost on the way
+type TxDetails struct {
+	Staged uint `json:"staged,omitempty"`
+}
@@ -1,3 +1,5 @@
 module github.com/ondbyte/simp_mq/simp_client
 
-go 1.16
+go 1.18
+
+require golang.org/x/crypto v0.1.0
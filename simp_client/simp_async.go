@@ -0,0 +1,185 @@
+package simp_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//publishes collected by PublishAsync to be sent in one frame
+type pendingBatch struct {
+	id       string
+	messages []*BatchMessage
+	futures  []*PublishFuture
+	timer    *time.Timer
+	//json size of the messages
+	size int
+}
+
+//size of the frame carrying the batch, the payload of a frame is base64 encoded in the json
+func batchFrameSize(messagesSize int) int {
+	payload := messagesSize + len(`{"messages":[]}`)
+	//room for the id of the batch
+	return (payload+2)/3*4 + len(`{"type":00,"id":"","payload":""}`) + 64
+}
+
+//publishes the payload to the topic without waiting for the broker, many publishes are in flight at once
+//over the connection and each future resolves when the broker acknowledges its message.
+//with a BatchLinger publishes are collected into one frame for up to the linger, MaxBatchSize publishes
+//or MaxBatchBytes, with an Outbox they go through the Outbox and are not batched
+func (client *SimpClient) PublishAsync(topic string, payload []byte, options *PubOptions) (*PublishFuture, error) {
+	if client.Outbox != nil {
+		return client.PublishBuffered(topic, payload, options)
+	}
+	var future *PublishFuture
+	err := client.intercept(context.Background(), topic, payload, options, func(ctx context.Context, deets *PubDetails) (err error) {
+		future, err = client.publishAsync(deets)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return future, nil
+}
+
+//sends the publish or adds it to the batch being collected
+func (client *SimpClient) publishAsync(deets *PubDetails) (*PublishFuture, error) {
+	future := newPublishFuture()
+	if client.BatchLinger > 0 {
+		err := client.addToBatch(&BatchMessage{ID: newID(), Pub: deets}, future)
+		if err != nil {
+			return nil, err
+		}
+		return future, nil
+	}
+	payload, err := json.Marshal(deets)
+	if err != nil {
+		return nil, err
+	}
+	data := &SimpData{Type: pub, ID: newID(), Payload: payload}
+	ch := make(chan error, 1)
+	client.mu.Lock()
+	client.waitingForPubAck[data.ID] = ch
+	client.unacked.add(data)
+	client.mu.Unlock()
+	err = client.send(data)
+	if err != nil {
+		client.mu.Lock()
+		delete(client.waitingForPubAck, data.ID)
+		client.unacked.remove(data.ID)
+		client.mu.Unlock()
+		return nil, err
+	}
+	go client.awaitAck(data.ID, ch, future)
+	return future, nil
+}
+
+//adds the publish to the batch being collected, the batch is sent once it holds MaxBatchSize publishes
+//or BatchLinger after its first publish, whichever comes first. a publish which would grow the frame
+//beyond MaxBatchBytes goes to the next batch
+func (client *SimpClient) addToBatch(message *BatchMessage, future *PublishFuture) error {
+	maxSize, maxBytes := client.MaxBatchSize, client.MaxBatchBytes
+	if maxSize == 0 {
+		maxSize = 100
+	}
+	if maxBytes == 0 {
+		maxBytes = client.frameLimit()
+	}
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	client.batchMu.Lock()
+	defer client.batchMu.Unlock()
+	if client.batch != nil && uint(batchFrameSize(client.batch.size+1+len(bytes))) > maxBytes {
+		client.batch.timer.Stop()
+		client.sendBatch(client.batch)
+		client.batch = nil
+	}
+	if client.batch == nil {
+		pending := &pendingBatch{id: "batch-" + message.ID}
+		pending.timer = time.AfterFunc(client.BatchLinger, func() {
+			client.flushBatch(pending)
+		})
+		client.batch = pending
+	}
+	pending := client.batch
+	pending.messages = append(pending.messages, message)
+	pending.futures = append(pending.futures, future)
+	pending.size += len(bytes) + 1
+	if uint(len(pending.messages)) >= maxSize {
+		pending.timer.Stop()
+		client.batch = nil
+		client.sendBatch(pending)
+	}
+	return nil
+}
+
+//largest frame the connection to the broker takes
+func (client *SimpClient) frameLimit() uint {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.conn == nil || client.conn.BufferSize == 0 {
+		return 1024
+	}
+	return client.conn.BufferSize
+}
+
+//sends the batch when the linger ran out, unless it was sent for being full already
+func (client *SimpClient) flushBatch(pending *pendingBatch) {
+	client.batchMu.Lock()
+	defer client.batchMu.Unlock()
+	if client.batch != pending {
+		return
+	}
+	client.batch = nil
+	client.sendBatch(pending)
+}
+
+//sends the batch, its futures resolve on the batchAck under its id. batches are sent holding batchMu so they
+//reach the broker in the order they were collected
+func (client *SimpClient) sendBatch(pending *pendingBatch) {
+	payload, err := (&BatchDetails{Messages: pending.messages}).Marshal()
+	if err == nil {
+		client.mu.Lock()
+		client.waitingForBatch[pending.id] = pending
+		client.mu.Unlock()
+		err = client.send(&SimpData{Type: batch, ID: pending.id, Payload: payload})
+	}
+	if err != nil {
+		client.mu.Lock()
+		delete(client.waitingForBatch, pending.id)
+		client.mu.Unlock()
+		pending.resolve(err)
+	}
+}
+
+//resolves the futures of the batch from its batchAck, the publishes listed as failed fail with their reason
+func (client *SimpClient) handleBatchAck(data *SimpData) {
+	client.mu.Lock()
+	pending, waiting := client.waitingForBatch[data.ID]
+	delete(client.waitingForBatch, data.ID)
+	client.mu.Unlock()
+	if !waiting {
+		return
+	}
+	deets, err := data.GetBatchDetails()
+	if err != nil {
+		pending.resolve(err)
+		return
+	}
+	for i, message := range pending.messages {
+		if reason, failed := deets.Failed[message.ID]; failed {
+			pending.futures[i].resolve(fmt.Errorf("refused by broker: %s", reason))
+		} else {
+			pending.futures[i].resolve(nil)
+		}
+	}
+}
+
+func (pending *pendingBatch) resolve(err error) {
+	for _, future := range pending.futures {
+		future.resolve(err)
+	}
+}
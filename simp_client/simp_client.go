@@ -1,196 +1,601 @@
 package simp_client
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 type SimpClient struct {
-	Id                 string                          //id
-	SimpBrokerHost     string                          //host address of the broker,mostly a local host
-	Token              string                          //token used to authenticate with the broker
-	subscriptions      map[string]SubscribtionListener //all subscriber according to topic
-	waitingForSubUnSub map[string]chan bool
-	waitingForPubAck   map[string]chan bool
-	conn               *SimpServerConn //connection to the server
-	connectedToServer  chan bool       //usd to close all dependencies
-	ConnectedToServer  bool            //whether connection is active
+	Id                  string                   //id
+	SimpBrokerHost      string                   //host address of the broker,mostly a local host
+	Token               string                   //token used to authenticate with the broker
+	AuthMechanism       string                   //MechanismPlain sends the token as is, MechanismScramSHA256 proves it without sending it, defaults to the one the broker prefers
+	subscriptions       map[string]*subscription //all subscriber according to topic
+	waitingForSubUnSub  map[string]chan error
+	waitingForPubAck    map[string]chan error
+	waitingForFetch     map[string]*fetchRequest  //fetch requests waiting for the broker to end them
+	pulls               map[string]bool           //topics with a pull subscription
+	conn                *SimpServerConn           //connection to the server
+	connectedToServer   chan bool                 //closed by Close to stop reconnecting
+	ConnectedToServer   bool                      //whether connection is active
+	state               ConnectionState           //see State
+	unacked             *pendingPublishes         //publishes waiting for their ack, resent after a reconnect with ResendPending
+	mu                  sync.Mutex                //guards the waiting maps shared with the read loop
+	Prefetch            uint                      //messages the broker may send to a subscription ahead of its listener, defaults to 64
+	MaxPrefetch         uint                      //prefetch of a subscription grows up to this while its listener keeps up, defaults to Prefetch
+	TLSConfig           *tls.Config               //connect over tls when set, add a client certificate for mutual tls, see LoadTLSConfig
+	TookOverSession     bool                      //whether the last connect took over the session of a connection with the same id
+	InheritedTopics     []string                  //topics subscribed by the connection whose session was taken over, subscribe to them to recieve their messages
+	OnSessionTakenOver  func(reason string)       //called with the reason when the broker drops this connection, another one took over the session or its namespace was removed
+	OnTakeoverRefused   func(reason string)       //called when the broker refused another connection with the id of this client, this one stays connected
+	KeyProvider         KeyProvider               //resolves the keys of encrypted messages by key id, see StaticKeys
+	EncryptionKeyID     string                    //payloads are encrypted end to end with this key when set, the broker only sees ciphertext
+	OnDecryptionError   func(err error)           //called with a DecryptionError for a message which could not be decrypted, the message is dropped
+	OperationTimeout    time.Duration             //longest the methods without a context wait for the broker, defaults to 30 seconds
+	AutoReconnect       bool                      //connect again when the connection is lost, subscriptions are restored afterwards
+	ReconnectBackoff    time.Duration             //delay before the first reconnect attempt, doubled with every failed attempt and jittered, defaults to 100 milliseconds
+	MaxReconnectDelay   time.Duration             //longest delay between reconnect attempts, defaults to 30 seconds
+	MaxReconnects       uint                      //attempts after which the client gives up reconnecting, never gives up when 0
+	ResendPending       bool                      //publishes waiting for their ack when the connection is lost are sent again after reconnecting instead of failing with ErrDisconnected, they may be delivered twice
+	OnDisconnect        func(err error)           //called when the connection is lost, before any reconnect attempt
+	OnReconnect         func()                    //called once reconnected and the subscriptions are restored
+	Outbox              Outbox                    //publishes are queued here and sent in order whenever connected when set, so they survive reconnects, see MemoryOutbox and FileOutbox
+	OutboxSize          uint                      //publishes the Outbox holds before OutboxOverflow applies, defaults to 1000
+	OutboxOverflow      OverflowPolicy            //what a publish to a full Outbox does, defaults to OverflowBlock
+	futures             map[string]*PublishFuture //futures of the publishes queued in the Outbox
+	outboxCond          *sync.Cond                //signalled when the Outbox or the state changes
+	restoring           bool                      //the subscriptions are being restored after a reconnect, the Outbox waits for it
+	outboxSending       string                    //id of the Outbox publish waiting for its ack, it stays first in the Outbox until then
+	BatchLinger         time.Duration             //PublishAsync collects publishes into one frame for up to this long when set
+	MaxBatchSize        uint                      //a batch is sent once it holds this many publishes, defaults to 100
+	MaxBatchBytes       uint                      //largest frame of a batch, defaults to the frame size agreed with the broker
+	batch               *pendingBatch             //batch being collected by PublishAsync
+	batchMu             sync.Mutex                //guards batch and keeps batches in order
+	waitingForBatch     map[string]*pendingBatch  //batches sent waiting for their batchAck
+	PublishInterceptors []PublishInterceptor      //wrap every publish, the first one outermost, see LogPublish and Metrics
+	DeliverInterceptors []DeliverInterceptor      //wrap every delivery to a listener or channel, the first one outermost, see LogDelivery and Metrics
+	MaxFrameSize        uint                      //largest frame sent or recieved, the broker lowers it to its MaxMessageBuffer when that is smaller, defaults to the MaxMessageBuffer of the broker
+	draining            bool                      //Drain was called, publishes are refused
+	publishing          uint                      //publishes past the draining check and not yet handed over, Drain waits for them
+}
+
+//context bounded by the OperationTimeout for the methods without a context
+func (client *SimpClient) operationContext() (context.Context, context.CancelFunc) {
+	timeout := client.OperationTimeout
+	if timeout == 0 {
+		timeout = time.Second * 30
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+//sends the request and waits for its answer under the id of the request in waiting, or until ctx ends,
+//the entry is registered before sending so a quick answer is not missed and removed either way
+//so a lost answer leaks nothing
+func (client *SimpClient) request(ctx context.Context, waiting map[string]chan error, data *SimpData) error {
+	ch := make(chan error, 1)
+	client.mu.Lock()
+	waiting[data.ID] = ch
+	if data.Type == pub {
+		client.unacked.add(data)
+	}
+	client.mu.Unlock()
+	defer func() {
+		client.mu.Lock()
+		delete(waiting, data.ID)
+		if data.Type == pub {
+			client.unacked.remove(data.ID)
+		}
+		client.mu.Unlock()
+	}()
+	err := client.send(data)
+	if err != nil {
+		return err
+	}
+	select {
+	case err, acknowledged := <-ch:
+		if !acknowledged {
+			return fmt.Errorf("no acknowledgement recieved")
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 //non blocking
-//establishes a connection to broker
+//establishes a connection to broker, with AutoReconnect a lost connection is established again
+//but the first connection must succeed
 //call Close to disconnect
 func (client *SimpClient) ConnectToServer() (err error) {
-	client.waitingForSubUnSub = make(map[string]chan bool)
-	client.subscriptions = make(map[string]SubscribtionListener)
-	client.waitingForPubAck = make(map[string]chan bool)
-	conn, err := net.Dial("tcp", client.SimpBrokerHost)
+	client.waitingForSubUnSub = make(map[string]chan error)
+	client.subscriptions = make(map[string]*subscription)
+	client.waitingForPubAck = make(map[string]chan error)
+	client.waitingForFetch = make(map[string]*fetchRequest)
+	client.pulls = make(map[string]bool)
+	client.unacked = newPendingPublishes()
+	client.futures = make(map[string]*PublishFuture)
+	client.draining = false
+	client.waitingForBatch = make(map[string]*pendingBatch)
+	client.outboxCond = sync.NewCond(&client.mu)
+	client.setState(StateConnecting)
+	simpConn, err := client.dial()
 	if err != nil {
+		client.setState(StateDisconnected)
 		return err
 	}
-	simpConn := &SimpServerConn{NetConn: conn, BufferSize: 1024, AuthDetails: &AuthDetails{
-		Token:    client.Token,
-		ClientID: client.Id,
+	fmt.Printf("SimpClient with id %s is active\n", client.Id)
+	client.TookOverSession = simpConn.Session.TookOver
+	client.InheritedTopics = simpConn.Session.Topics
+	client.connectedToServer = make(chan bool)
+	client.mu.Lock()
+	client.conn = simpConn
+	client.state = StateConnected
+	client.mu.Unlock()
+	client.ConnectedToServer = true
+	go client.readLoop(simpConn)
+	if client.Outbox != nil {
+		go client.pumpOutbox()
+	}
+	return nil
+}
+
+//opens and authenticates a new connection to the broker
+func (client *SimpClient) dial() (*SimpServerConn, error) {
+	var conn net.Conn
+	var err error
+	if client.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", client.SimpBrokerHost, client.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", client.SimpBrokerHost)
+	}
+	if err != nil {
+		return nil, err
+	}
+	maxFrameSize := client.MaxFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = 1024
+	}
+	simpConn := &SimpServerConn{NetConn: conn, BufferSize: maxFrameSize, AuthDetails: &AuthDetails{
+		Token:        client.Token,
+		ClientID:     client.Id,
+		Mechanism:    client.AuthMechanism,
+		MaxFrameSize: client.MaxFrameSize,
 	}}
 
 	err = simpConn.authenticateWithBroker()
 
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
-	fmt.Printf("SimpClient with id %s is active\n", client.Id)
-	client.conn = simpConn
-	// start a go routine loop to wait for next data from server
-	go func() {
-		for {
-			data, err := simpConn.nextDataFromConnection()
-			if err == nil {
-				switch data.Type {
-
-				case pub:
-					{
-						//handle a published message
-						deets, err := data.GetPubDetails()
-						if err == nil {
-							listener, waiting := client.subscriptions[deets.Topic]
-							if waiting {
-								listener(deets.Data)
-							}
-						} else {
-							fmt.Println("unable to get pub details code: xyz122")
-						}
-					}
+	return simpConn, nil
+}
 
-				case subAck, unsubAck:
-					{
-						//handle a subscribe acknowledgement message
-						ch, waiting := client.waitingForSubUnSub[data.ID]
+//blocking, handles data from the server until the connection fails
+func (client *SimpClient) readLoop(simpConn *SimpServerConn) {
+	for {
+		data, err := simpConn.nextDataFromConnection()
+		if err != nil {
+			client.connectionLost(simpConn, err)
+			return
+		}
+		switch data.Type {
+
+		case pub:
+			{
+				//handle a published message
+				deets, err := data.GetPubDetails()
+				if err == nil {
+					client.mu.Lock()
+					subscription, waiting := client.subscriptions[deets.Topic]
+					client.mu.Unlock()
+					err = client.decrypt(deets)
+					if err != nil {
+						client.decryptionFailed(err)
+						//it still used one of the broker's credits
 						if waiting {
-							ch <- true
+							subscription.skip()
 						}
+						break
 					}
-				case pubAck:
-					{
-						//handle a publish acknowledgement message
-						ch, waiting := client.waitingForPubAck[data.ID]
-						if waiting {
-							ch <- true
-						}
+					if waiting {
+						subscription.deliver(&Message{Topic: deets.Topic, Data: deets.Data, Headers: deets.Headers})
 					}
+				} else {
+					fmt.Println("unable to get pub details code: xyz122")
+				}
+			}
+
+		case subAck, unsubAck:
+			{
+				//handle a subscribe acknowledgement message
+				client.mu.Lock()
+				ch, waiting := client.waitingForSubUnSub[data.ID]
+				client.mu.Unlock()
+				if waiting {
+					ch <- nil
+				}
+			}
+		case fetchMsg, fetchEnd:
+			{
+				client.handleFetchData(data)
+			}
+		case batchAck:
+			{
+				client.handleBatchAck(data)
+			}
+		case nack:
+			{
+				//the broker refused a request, its caller gets the reason
+				client.handleNack(data)
+			}
+		case disconnect:
+			{
+				//the broker is dropping this connection, another one took over the session or the namespace is gone,
+				//reconnecting would only fight over the session so the client is closed
+				reason := "disconnected by broker"
+				deets, err := data.GetErrorDetails()
+				if err == nil && len(deets.Message) > 0 {
+					reason = deets.Message
+				}
+				fmt.Printf("[%s] %s\n", client.Id, reason)
+				client.Close()
+				if client.OnSessionTakenOver != nil {
+					client.OnSessionTakenOver(reason)
+				}
+			}
+		case takeoverRefused:
+			{
+				//someone authenticated with the id of this client, the broker kept this connection
+				reason := "a connection with the id of the client was refused"
+				deets, err := data.GetErrorDetails()
+				if err == nil && len(deets.Message) > 0 {
+					reason = deets.Message
+				}
+				fmt.Printf("[%s] %s\n", client.Id, reason)
+				if client.OnTakeoverRefused != nil {
+					client.OnTakeoverRefused(reason)
+				}
+			}
+		case pubAck, txAck, ackAck:
+			{
+				//handle a publish, transaction commit or message ack acknowledgement
+				client.mu.Lock()
+				ch, waiting := client.waitingForPubAck[data.ID]
+				client.mu.Unlock()
+				if waiting {
+					ch <- nil
 				}
 			}
 		}
-	}()
-	//wait for closing event
-	go func() {
-		_, more := <-client.connectedToServer
-		if !more {
-			conn.Close()
-			fmt.Printf("[%s] disconnected from broker %s and exited\n", client.Id, conn.RemoteAddr())
-		}
-	}()
-	client.ConnectedToServer = true
-	client.connectedToServer = make(chan bool)
-	return nil
+	}
 }
 
+//disconnects from the broker for good, no reconnect is attempted afterwards, requests waiting for
+//the broker fail with ErrDisconnected. call Drain to finish them first
 func (client *SimpClient) Close() {
-	if client.ConnectedToServer {
-		client.ConnectedToServer = false
-		close(client.connectedToServer)
+	client.mu.Lock()
+	if client.state == StateClosed || client.conn == nil {
+		client.mu.Unlock()
+		return
+	}
+	client.state = StateClosed
+	client.outboxCond.Broadcast()
+	client.failPending(false)
+	client.endSubscriptions(ErrClosed)
+	conn := client.conn
+	client.mu.Unlock()
+	client.ConnectedToServer = false
+	close(client.connectedToServer)
+	conn.NetConn.Close()
+	fmt.Printf("[%s] disconnected from broker %s and exited\n", client.Id, conn.NetConn.RemoteAddr())
+}
+
+//hands the reason a request was refused by the broker to whoever waits for the request
+func (client *SimpClient) handleNack(data *SimpData) {
+	reason := "request refused by broker"
+	deets, err := data.GetErrorDetails()
+	if err == nil && len(deets.Message) > 0 {
+		reason = deets.Message
+	}
+	refused := fmt.Errorf("refused by broker: %s", reason)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if ch, waiting := client.waitingForPubAck[data.ID]; waiting {
+		ch <- refused
+	}
+	if ch, waiting := client.waitingForSubUnSub[data.ID]; waiting {
+		ch <- refused
+	}
+	if request, waiting := client.waitingForFetch[data.ID]; waiting {
+		request.err = refused
+		close(request.done)
+		delete(client.waitingForFetch, data.ID)
+	}
+	if pending, waiting := client.waitingForBatch[data.ID]; waiting {
+		pending.resolve(refused)
+		delete(client.waitingForBatch, data.ID)
 	}
 }
 
 type SubscribtionListener func([]byte)
 
-//subcribe to the given topic, messages will be delivered on the listener
-//completes when a subscription acknowledgement is recieved, which is not guaranteed in real life conditions
-func (client *SimpClient) Subscribe(topic string, listener SubscribtionListener) error {
-	_, alreadyTrying := client.waitingForSubUnSub[topic]
-	if alreadyTrying {
-		return fmt.Errorf("subscription/unsubscription request aleady sent for topic %s, waiting for acknowledgement from broker", topic)
-	}
-	_, alreadySubscribed := client.subscriptions[topic]
-	if alreadySubscribed {
-		return fmt.Errorf("already subscribed to topic %s, waiting for new messages to arrive", topic)
+//the listener as the handler of a local subscription
+func (listener SubscribtionListener) handler() func(*Message) {
+	return func(message *Message) {
+		listener(message.Data)
 	}
-	id := string(rune(time.Now().UnixNano()))
-	deets := &SubDetails{Topic: topic}
-	payload, err := deets.Marshal()
+}
+
+//subcribe to the given topic, messages will be delivered on the listener, several listeners of a topic
+//share one subscription at the broker, UnSubscribe ends all of them.
+//completes when a subscription acknowledgement is recieved or fails after the OperationTimeout
+func (client *SimpClient) Subscribe(topic string, listener SubscribtionListener) error {
+	_, err := client.SubscribeListener(topic, listener)
+	return err
+}
+
+//Subscribe which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) SubscribeCtx(ctx context.Context, topic string, listener SubscribtionListener) error {
+	_, err := client.SubscribeListenerCtx(ctx, topic, listener)
+	return err
+}
+
+//Subscribe which returns a handle to end only this listener, the broker is told once the last
+//listener or channel of the topic ends
+func (client *SimpClient) SubscribeListener(topic string, listener SubscribtionListener) (Subscription, error) {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.SubscribeListenerCtx(ctx, topic, listener)
+}
+
+//SubscribeListener which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) SubscribeListenerCtx(ctx context.Context, topic string, listener SubscribtionListener) (Subscription, error) {
+	local, err := client.subscribe(ctx, &SubDetails{Topic: topic}, listener.handler(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = client.conn.respond(&SimpData{Type: sub, ID: id, Payload: payload})
+	return local, nil
+}
+
+//subscribes to the topic, messages are sent on the returned channel which holds up to bufferSize of them,
+//messages arriving while it is full are dropped and counted by the Subscription. the channel is closed
+//when the subscription ends, the Subscription tells why.
+//fails after the OperationTimeout
+func (client *SimpClient) SubscribeChan(topic string, bufferSize uint) (<-chan Message, Subscription, error) {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.SubscribeChanCtx(ctx, topic, bufferSize)
+}
+
+//SubscribeChan which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) SubscribeChanCtx(ctx context.Context, topic string, bufferSize uint) (<-chan Message, Subscription, error) {
+	out := make(chan Message, bufferSize)
+	local, err := client.subscribe(ctx, &SubDetails{Topic: topic}, nil, out)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	ch := make(chan bool)
-	client.waitingForSubUnSub[id] = ch
-	_, subscribed := <-ch
-	delete(client.waitingForSubUnSub, id)
+	return out, local, nil
+}
+
+//joins the shared subscription group on the topic, each message is delivered to only one member of the group,
+//messages published with the same key are delivered in order to the same member while the group is stable
+func (client *SimpClient) SubscribeShared(topic string, group string, listener SubscribtionListener) error {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.SubscribeSharedCtx(ctx, topic, group, listener)
+}
 
-	if !subscribed {
-		return fmt.Errorf("failed to subscribe to %s", topic)
+//SubscribeShared which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) SubscribeSharedCtx(ctx context.Context, topic string, group string, listener SubscribtionListener) error {
+	if len(group) == 0 {
+		return fmt.Errorf("group of a shared subscription cannot be empty")
 	}
+	_, err := client.subscribe(ctx, &SubDetails{Topic: topic, Group: group}, listener.handler(), nil)
+	return err
+}
 
-	client.subscriptions[topic] = listener
-	close(ch)
-	return nil
+//adds a local subscription with the handler, or the out channel when it is set. the first one of a topic
+//subscribes at the broker, the others join it once the broker acknowledged it
+func (client *SimpClient) subscribe(ctx context.Context, deets *SubDetails, handler func(*Message), out chan Message) (*localSubscription, error) {
+	topic := deets.Topic
+	for {
+		client.mu.Lock()
+		subscription, subscribed := client.subscriptions[topic]
+		if !subscribed {
+			break
+		}
+		client.mu.Unlock()
+		if subscription.group != deets.Group {
+			return nil, fmt.Errorf("already subscribed to topic %s in group %q", topic, subscription.group)
+		}
+		local, unsubscribing := subscription.add(handler, out)
+		if local == nil {
+			//the last one is unsubscribing at the broker, join again once it answered
+			select {
+			case <-unsubscribing:
+				continue
+			case <-ctx.Done():
+				return nil, fmt.Errorf("failed to subscribe to %s: %w", topic, ctx.Err())
+			}
+		}
+		select {
+		case <-subscription.subscribed:
+			return local, nil
+		case <-subscription.done:
+			return nil, fmt.Errorf("failed to subscribe to %s: %w", topic, subscription.err)
+		case <-ctx.Done():
+			subscription.remove(local, false)
+			local.end(nil)
+			return nil, fmt.Errorf("failed to subscribe to %s: %w", topic, ctx.Err())
+		}
+	}
+	//registered before the request so messages sent right after the acknowledgement are not lost
+	subscription := newSubscription(client, topic)
+	subscription.group = deets.Group
+	local, _ := subscription.add(handler, out)
+	client.subscriptions[topic] = subscription
+	client.mu.Unlock()
+	deets.Credits = subscription.window
+	err := client.sendSubUnSub(ctx, sub, deets)
+	if err != nil {
+		client.mu.Lock()
+		delete(client.subscriptions, topic)
+		client.mu.Unlock()
+		if ctx.Err() != nil {
+			//the broker may still subscribe after giving up, undo it without waiting
+			client.cancelSubscription(deets)
+		}
+		err = fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+		//listeners which joined meanwhile fail along
+		subscription.end(err)
+		return nil, err
+	}
+	close(subscription.subscribed)
+	return local, nil
+}
+
+//ends the local subscription, the last one of its topic unsubscribes at the broker. the handle is removed
+//and the ones left are counted at once, so a listener joining meanwhile either keeps the subscription
+//or waits for the broker's answer and subscribes anew
+func (client *SimpClient) unsubscribeLocal(ctx context.Context, local *localSubscription) error {
+	subscription := local.parent
+	client.mu.Lock()
+	current := client.subscriptions[subscription.topic] == subscription
+	client.mu.Unlock()
+	last := subscription.remove(local, current)
+	local.end(nil)
+	if !last {
+		return nil
+	}
+	return client.unsubscribeAtBroker(ctx, subscription)
 }
 
-//subcribe to the given topic, messages will be delivered on the listener
+//unsubcribe from the given topic, a pull subscription is deleted along with the messages it holds,
+//fails after the OperationTimeout
 func (client *SimpClient) UnSubscribe(topic string) error {
-	_, alreadyTrying := client.waitingForSubUnSub[topic]
-	if alreadyTrying {
-		return fmt.Errorf("subscription/unsubscription request aleady sent for topic %s, waiting for acknowledgement from broker", topic)
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.UnSubscribeCtx(ctx, topic)
+}
+
+//UnSubscribe which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) UnSubscribeCtx(ctx context.Context, topic string) error {
+	client.mu.Lock()
+	if client.pulls[topic] {
+		client.mu.Unlock()
+		err := client.sendSubUnSub(ctx, unsub, &SubDetails{Topic: topic, Pull: true})
+		if err != nil {
+			return fmt.Errorf("failed to unsubscribe to topic %s: %w", topic, err)
+		}
+		client.mu.Lock()
+		delete(client.pulls, topic)
+		client.mu.Unlock()
+		return nil
 	}
-	_, alreadySubscribed := client.subscriptions[topic]
+	subscription, alreadySubscribed := client.subscriptions[topic]
+	client.mu.Unlock()
 	if !alreadySubscribed {
 		return fmt.Errorf("not subscribed to topic %s to unsubscribe", topic)
 	}
-	id := string(rune(time.Now().UnixNano()))
-	payload, err := json.Marshal(&SubDetails{Topic: topic})
-	if err != nil {
-		return err
+	if !subscription.beginUnsubscribe() {
+		return fmt.Errorf("unsubscription request aleady sent for topic %s, waiting for acknowledgement from broker", topic)
 	}
-	err = client.conn.respond(&SimpData{Type: unsub, ID: id, Payload: payload})
-	if err != nil {
-		return err
+	return client.unsubscribeAtBroker(ctx, subscription)
+}
+
+//tells the broker to drop the unsubscribing subscription, it ends once the broker acknowledged it and
+//stays otherwise
+func (client *SimpClient) unsubscribeAtBroker(ctx context.Context, subscription *subscription) error {
+	err := client.sendSubUnSub(ctx, unsub, &SubDetails{Topic: subscription.topic})
+	if err == nil {
+		client.mu.Lock()
+		if client.subscriptions[subscription.topic] == subscription {
+			delete(client.subscriptions, subscription.topic)
+		}
+		client.mu.Unlock()
+		subscription.close()
 	}
-	ch := make(chan bool)
-	client.waitingForSubUnSub[id] = ch
-	_, unsubscribed := <-ch
-	delete(client.waitingForSubUnSub, id)
-	if !unsubscribed {
-		return fmt.Errorf("failed to unsubscribe to topic %s", topic)
+	subscription.unsubscribed()
+	if err != nil {
+		return fmt.Errorf("failed to unsubscribe to topic %s: %w", subscription.topic, err)
 	}
-	close(ch)
 	return nil
 }
 
-//get a channel to publish to a topic, add a message to the returned pb channel to publish a message
-//closing the channel will stop you from publishing to this topic which also closes the ackknowledgment channel
-//you'll recieve ID of the message acknowledgemnt by broker on ack channel
-func (client *SimpClient) Publish(topic string, payload []byte) error {
-	id := topic + string(rune(time.Now().UnixNano()))
-	payload, err := json.Marshal(&PubDetails{Topic: topic, Data: payload})
+//sends a subscription or unsubscription request and waits for its acknowledgement
+func (client *SimpClient) sendSubUnSub(ctx context.Context, messageType MessagType, deets *SubDetails) error {
+	id := newID()
+	payload, err := json.Marshal(deets)
 	if err != nil {
 		return err
 	}
-	err = client.conn.respond(&SimpData{Type: pub, ID: id, Payload: payload})
+	return client.request(ctx, client.waitingForSubUnSub, &SimpData{Type: messageType, ID: id, Payload: payload})
+}
+
+//asks the broker to drop a subscription whose request was given up on, nobody waits for the answer
+func (client *SimpClient) cancelSubscription(deets *SubDetails) {
+	payload, err := json.Marshal(&SubDetails{Topic: deets.Topic, Pull: deets.Pull})
 	if err != nil {
-		return err
+		return
 	}
+	client.send(&SimpData{Type: unsub, ID: newID(), Payload: payload})
+}
 
-	ch := make(chan bool)
-	client.waitingForPubAck[id] = ch
-	_, open := <-ch
-	close(ch)
-	delete(client.waitingForPubAck, id)
-	if !open {
-		return fmt.Errorf("failed to recieve acknowledgement for message")
-	}
-	return nil
+//options for a message being published
+type PubOptions struct {
+	//when a subscriber falls behind, messages with higher priority are delivered to it first,
+	//0 is the lowest priority, the broker clamps values above its highest level
+	Priority uint
+	//partition key, messages with the same key are delivered in publish order to the same member of
+	//a shared subscription, use a single priority for messages of a key when their order matters
+	Key string
+	//encrypts the payload with the key of this id, overrides the EncryptionKeyID of the client
+	EncryptionKeyID string
+	//metadata sent along with the message, subscribers find it in Message.Headers
+	Headers map[string]string
+}
+
+//publishes the payload to the topic with default options,
+//completes when the broker acknowledges the message or fails after the OperationTimeout
+func (client *SimpClient) Publish(topic string, payload []byte) error {
+	return client.PublishWithOptions(topic, payload, nil)
+}
+
+//Publish which gives up with the error of ctx when it ends before the acknowledgement,
+//the message may still be published
+func (client *SimpClient) PublishCtx(ctx context.Context, topic string, payload []byte) error {
+	return client.PublishWithOptionsCtx(ctx, topic, payload, nil)
+}
+
+//publishes the payload to the topic using the options, nil options are the defaults,
+//completes when the broker acknowledges the message or fails after the OperationTimeout
+func (client *SimpClient) PublishWithOptions(topic string, payload []byte, options *PubOptions) error {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.PublishWithOptionsCtx(ctx, topic, payload, options)
+}
+
+//PublishWithOptions which gives up with the error of ctx when it ends before the acknowledgement,
+//the message may still be published. with an Outbox the message is queued there and waited for
+func (client *SimpClient) PublishWithOptionsCtx(ctx context.Context, topic string, payload []byte, options *PubOptions) error {
+	return client.intercept(ctx, topic, payload, options, func(ctx context.Context, deets *PubDetails) error {
+		if client.Outbox != nil {
+			future, err := client.enqueue(ctx, deets)
+			if err != nil {
+				return err
+			}
+			return future.Wait(ctx)
+		}
+		payload, err := json.Marshal(deets)
+		if err != nil {
+			return err
+		}
+		return client.request(ctx, client.waitingForPubAck, &SimpData{Type: pub, ID: newID(), Payload: payload})
+	})
 }
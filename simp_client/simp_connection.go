@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -22,6 +24,8 @@ type SimpClientConn struct {
 	WaitForAuthentication time.Duration //wait window till the AuthDetails arrives after which connection fails
 
 	Id string //id
+
+	decoder *frameDecoder //reads SimpData from the connection stream
 }
 
 //stores connection to a server on client
@@ -35,11 +39,35 @@ type SimpServerConn struct {
 	AuthDetails *AuthDetails //details to authenticate with broker
 
 	Id string //id
+
+	decoder *frameDecoder //reads SimpData from the connection stream
+
+	Session *SessionDetails //session the broker attached the connection to
 }
 
-//attempts to authenticate with the server using the AuthDetails
+//attempts to authenticate with the server using the AuthDetails, with MechanismScramSHA256 the token
+//is the secret the client proves to know in a challenge-response exchange instead of sending it.
+//the broker greets the connection with the mechanisms it offers, without a mechanism in the AuthDetails
+//the client takes the one the broker prefers
 func (sc *SimpServerConn) authenticateWithBroker() (err error) {
-	bytes, err := json.Marshal(sc.AuthDetails)
+	first := *sc.AuthDetails
+	//a client with a secret but no mechanism asks the broker which ones it offers, the secret is never sent
+	//in plain unless the client opted into it
+	if len(first.Mechanism) == 0 && len(first.Token) > 0 {
+		first.Mechanism, err = sc.askForMechanisms()
+		if err != nil {
+			return err
+		}
+	}
+	scram := first.Mechanism == MechanismScramSHA256
+	if scram {
+		first.Token = ""
+		first.Nonce, err = newScramNonce()
+		if err != nil {
+			return err
+		}
+	}
+	bytes, err := json.Marshal(&first)
 	if err != nil {
 		return err
 	}
@@ -48,23 +76,102 @@ func (sc *SimpServerConn) authenticateWithBroker() (err error) {
 	if err != nil {
 		return err
 	}
-	data, err := nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	data, err := nextDataFromConnection(sc.BufferSize, sc.reader())
 	if err != nil {
 		return err
 	}
-	if data.Type != authAck || data.ID != sc.Id {
+	if data.Type == nack {
+		return refusedAuthentication(data)
+	}
+	if scram {
+		if data.Type != authChallenge {
+			return fmt.Errorf("broker did not challenge the client for %s", MechanismScramSHA256)
+		}
+		err = sc.proveToBroker(sc.AuthDetails.Token, first.Nonce, data)
+		if err != nil {
+			return err
+		}
+	} else if data.Type != authAck || data.ID != sc.Id {
 		return fmt.Errorf("failed to authenticate from client because no auth ack recieved")
 	}
+	//the broker tells whether the connection took over the session of an earlier one with the same id
+	data, err = nextDataFromConnection(sc.BufferSize, sc.reader())
+	if err != nil {
+		return err
+	}
+	if data.Type != session {
+		return fmt.Errorf("failed to authenticate from client because no session recieved")
+	}
+	sc.Session, err = data.GetSessionDetails()
+	if err != nil {
+		return err
+	}
+	//a broker which does not negotiate keeps the size of the client
+	if sc.Session.MaxFrameSize > 0 {
+		sc.BufferSize = sc.Session.MaxFrameSize
+	}
 	sc.authenticated = true
 	return nil
 }
 
+//the mechanism the client asked for if the broker offers it, the broker's first one when it asked for none
+//asks the broker for the mechanisms it offers and picks one of them
+func (sc *SimpServerConn) askForMechanisms() (string, error) {
+	bytes, err := json.Marshal(&AuthDetails{ClientID: sc.AuthDetails.ClientID, Mechanism: listMechanisms})
+	if err != nil {
+		return "", err
+	}
+	err = respond(&SimpData{Type: auth, Payload: bytes, ID: sc.Id}, sc.NetConn)
+	if err != nil {
+		return "", err
+	}
+	data, err := nextDataFromConnection(sc.BufferSize, sc.reader())
+	if err != nil {
+		return "", err
+	}
+	if data.Type != hello {
+		return "", fmt.Errorf("broker did not offer its authentication mechanisms, set AuthMechanism to %s to send the token in plain", MechanismPlain)
+	}
+	greeting, err := data.GetHelloDetails()
+	if err != nil {
+		return "", err
+	}
+	return pickMechanism(greeting.Mechanisms)
+}
+
+//scram whenever the broker offers it, plain needs to be asked for explicitly
+func pickMechanism(offered []string) (string, error) {
+	for _, mechanism := range offered {
+		if mechanism == MechanismScramSHA256 {
+			return mechanism, nil
+		}
+	}
+	return "", fmt.Errorf("broker does not offer %s, supported mechanisms: %s, set AuthMechanism to %s to send the token in plain", MechanismScramSHA256, strings.Join(offered, ", "), MechanismPlain)
+}
+
+//error with the reason the broker refused to authenticate the client
+func refusedAuthentication(data *SimpData) error {
+	deets, err := data.GetErrorDetails()
+	if err != nil || len(deets.Message) == 0 {
+		return fmt.Errorf("broker refused to authenticate the client")
+	}
+	return fmt.Errorf("broker refused to authenticate the client: %s", deets.Message)
+}
+
 //fails if not authenticated, waits for next data to arrive
 func (sc *SimpServerConn) nextDataFromConnection() (*SimpData, error) {
 	if !sc.authenticated {
 		return nil, fmt.Errorf("connection is not authenticated to read")
 	}
-	return nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	return nextDataFromConnection(sc.BufferSize, sc.reader())
+}
+
+//decoder for the data coming from the server, created on first use
+func (sc *SimpServerConn) reader() *frameDecoder {
+	if sc.decoder == nil {
+		sc.decoder = newFrameDecoder(sc.NetConn)
+	}
+	return sc.decoder
 }
 
 //fails if not authenticated, send data to server
@@ -72,7 +179,7 @@ func (sc *SimpServerConn) respond(data *SimpData) (err error) {
 	if !sc.authenticated {
 		return fmt.Errorf("connection is not authenticated to respond")
 	}
-	return respond(data, sc.NetConn)
+	return respondWithin(data, sc.NetConn, sc.BufferSize)
 }
 
 //authenticates using provided autheticator funtion provided to the instance
@@ -85,7 +192,7 @@ func (sc *SimpClientConn) authenticateWithClient() (data *SimpData, err error) {
 		sc.WaitForAuthentication = time.Second * 16
 	}
 	sc.NetConn.SetReadDeadline(time.Now().Add(sc.WaitForAuthentication))
-	data, err = nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	data, err = nextDataFromConnection(sc.BufferSize, sc.reader())
 	var t time.Time
 	sc.NetConn.SetReadDeadline(t)
 
@@ -113,6 +220,14 @@ func (sc *SimpClientConn) authenticateWithClient() (data *SimpData, err error) {
 	}
 }
 
+//decoder for the data coming from the client, created on first use
+func (sc *SimpClientConn) reader() *frameDecoder {
+	if sc.decoder == nil {
+		sc.decoder = newFrameDecoder(sc.NetConn)
+	}
+	return sc.decoder
+}
+
 //closes the connection
 func (sc *SimpClientConn) close() {
 	err := sc.NetConn.Close()
@@ -126,7 +241,7 @@ func (sc *SimpClientConn) nextDataFromConnection() (*SimpData, error) {
 	if !sc.authenticated {
 		return nil, fmt.Errorf("connection is not authenticated to read")
 	}
-	return nextDataFromConnection(sc.BufferSize, sc.NetConn)
+	return nextDataFromConnection(sc.BufferSize, sc.reader())
 }
 
 //send data to the client
@@ -134,14 +249,26 @@ func (sc *SimpClientConn) respond(data *SimpData) (err error) {
 	if !sc.authenticated {
 		return fmt.Errorf("connection is not authenticated to respond")
 	}
-	return respond(data, sc.NetConn)
+	return respondWithin(data, sc.NetConn, sc.BufferSize)
 }
 
+//sending a frame bigger than the maximum frame size agreed with the other side fails with this,
+//nothing is written so the connection stays usable
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
 func respond(data *SimpData, NetConn net.Conn) (err error) {
+	return respondWithin(data, NetConn, 0)
+}
+
+//sends the data unless its frame is bigger than maxSize, any size goes when maxSize is 0
+func respondWithin(data *SimpData, NetConn net.Conn, maxSize uint) (err error) {
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
+	if maxSize > 0 && uint(len(bytes)) > maxSize {
+		return fmt.Errorf("%w: frame of %d bytes, maximum %d", ErrFrameTooLarge, len(bytes), maxSize)
+	}
 	_, err = NetConn.Write(bytes)
 	if err != nil {
 		return err
@@ -149,26 +276,62 @@ func respond(data *SimpData, NetConn net.Conn) (err error) {
 	return
 }
 
-func nextDataFromConnection(BufferSize uint, NetConn net.Conn) (*SimpData, error) {
-	buf := make([]byte, BufferSize)
-	readLen, err := NetConn.Read(buf[0:])
+//decodes SimpData value by value from a connection stream, the decoder only gets to read as many bytes
+//as one frame may have so a peer streaming an endless value can not make it buffer more than that
+type frameDecoder struct {
+	conn    io.Reader
+	decoder *json.Decoder
+	//bytes the decoder may still read for the current frame
+	remaining uint
+	//set once the decoder wanted more than the current frame may have
+	exceeded bool
+}
 
-	if err != nil {
-		return nil, err
+func newFrameDecoder(conn io.Reader) *frameDecoder {
+	fd := &frameDecoder{conn: conn}
+	fd.decoder = json.NewDecoder(fd)
+	return fd
+}
 
-	} else {
-		simpData := &SimpData{}
-		err = json.Unmarshal(buf[:readLen], simpData)
-		if err != nil {
-			var serr *json.SyntaxError
-			if errors.As(err, &serr) {
-				return nil, fmt.Errorf("no other clients are supported, calls to SimpBroker must be made from a SimpClient\n%s\n%s",
-					"please check https://github.com/ondbyte/simp_mq to know which languages have SimpClient implementation",
-					"if you need a SimplClient implemented in a new language, please place a feature request")
-			}
-			return nil, err
-		} else {
-			return simpData, nil
+func (fd *frameDecoder) Read(p []byte) (int, error) {
+	if fd.remaining == 0 {
+		fd.exceeded = true
+		return 0, io.EOF
+	}
+	if uint(len(p)) > fd.remaining {
+		p = p[:fd.remaining]
+	}
+	n, err := fd.conn.Read(p)
+	fd.remaining -= uint(n)
+	return n, err
+}
+
+//reads the next SimpData from the connection, tcp may split or coalesce writes so the stream is decoded
+//value by value instead of a single read per message, fails if a message is bigger than BufferSize
+//without reading more than BufferSize bytes of it
+func nextDataFromConnection(BufferSize uint, fd *frameDecoder) (*SimpData, error) {
+	//what the decoder buffered already belongs to this frame or later ones, so reading BufferSize
+	//more bytes is enough to complete any frame which is not too big
+	fd.remaining = BufferSize
+	fd.exceeded = false
+	decoder := fd.decoder
+	start := decoder.InputOffset()
+	simpData := &SimpData{}
+	err := decoder.Decode(simpData)
+	if err != nil {
+		if fd.exceeded {
+			return nil, fmt.Errorf("message exceeds the maximum message size %d", BufferSize)
+		}
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			return nil, fmt.Errorf("no other clients are supported, calls to SimpBroker must be made from a SimpClient\n%s\n%s",
+				"please check https://github.com/ondbyte/simp_mq to know which languages have SimpClient implementation",
+				"if you need a SimplClient implemented in a new language, please place a feature request")
 		}
+		return nil, err
+	}
+	if size := decoder.InputOffset() - start; uint(size) > BufferSize {
+		return nil, fmt.Errorf("message of size %d exceeds the maximum message size %d", size, BufferSize)
 	}
+	return simpData, nil
 }
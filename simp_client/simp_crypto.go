@@ -0,0 +1,148 @@
+package simp_client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const (
+	//header naming the cipher of an encrypted payload
+	HeaderEncryption = "simp-encryption"
+	//header carrying the id of the key a payload was encrypted with
+	HeaderKeyID = "simp-key-id"
+	//the only cipher so far, the nonce is prepended to the sealed payload and the topic is authenticated with it
+	EncryptionAESGCM = "AES-GCM"
+)
+
+//resolves the AES key of a key id, 16, 24 or 32 bytes for AES-128, AES-192 or AES-256,
+//return an error for unknown ids
+type KeyProvider interface {
+	Key(keyID string) ([]byte, error)
+}
+
+//KeyProvider serving keys held in memory by key id
+type StaticKeys map[string][]byte
+
+func (keys StaticKeys) Key(keyID string) ([]byte, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no key with id %s", keyID)
+	}
+	return key, nil
+}
+
+//a message could not be decrypted, it is not delivered to the listener
+type DecryptionError struct {
+	Topic string
+	KeyID string
+	//offset of a fetched message so it can still be acknowledged, 0 for pushed messages
+	Offset uint64
+	Err    error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("failed to decrypt message on topic %s with key id %s: %v", e.Topic, e.KeyID, e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+func (client *SimpClient) aead(keyID string) (cipher.AEAD, error) {
+	if client.KeyProvider == nil {
+		return nil, errors.New("SimpClient has no KeyProvider")
+	}
+	key, err := client.KeyProvider.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//seals the data of the message with the key of the id and marks it in the headers
+func (client *SimpClient) encrypt(deets *PubDetails, keyID string) error {
+	aead, err := client.aead(keyID)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message on topic %s with key id %s: %w", deets.Topic, keyID, err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(deets.Data)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	deets.Data = aead.Seal(nonce, nonce, deets.Data, []byte(deets.Topic))
+	if deets.Headers == nil {
+		deets.Headers = make(map[string]string)
+	}
+	deets.Headers[HeaderEncryption] = EncryptionAESGCM
+	deets.Headers[HeaderKeyID] = keyID
+	return nil
+}
+
+//opens the data of an encrypted message in place, messages without encryption headers are left as they are
+func (client *SimpClient) decrypt(deets *PubDetails) error {
+	encryption, encrypted := deets.Headers[HeaderEncryption]
+	if !encrypted {
+		return nil
+	}
+	keyID := deets.Headers[HeaderKeyID]
+	if encryption != EncryptionAESGCM {
+		return &DecryptionError{Topic: deets.Topic, KeyID: keyID, Err: fmt.Errorf("unsupported encryption %s", encryption)}
+	}
+	aead, err := client.aead(keyID)
+	if err != nil {
+		return &DecryptionError{Topic: deets.Topic, KeyID: keyID, Err: err}
+	}
+	if len(deets.Data) < aead.NonceSize() {
+		return &DecryptionError{Topic: deets.Topic, KeyID: keyID, Err: errors.New("ciphertext too short")}
+	}
+	nonce, sealed := deets.Data[:aead.NonceSize()], deets.Data[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, []byte(deets.Topic))
+	if err != nil {
+		return &DecryptionError{Topic: deets.Topic, KeyID: keyID, Err: err}
+	}
+	deets.Data = data
+	return nil
+}
+
+//reports a message that could not be decrypted
+func (client *SimpClient) decryptionFailed(err error) {
+	if client.OnDecryptionError != nil {
+		client.OnDecryptionError(err)
+		return
+	}
+	fmt.Printf("[%s] %v\n", client.Id, err)
+}
+
+//details of a message to publish, encrypted when the options or the client name a key id
+func (client *SimpClient) pubDetails(topic string, payload []byte, options *PubOptions) (*PubDetails, error) {
+	if options == nil {
+		options = &PubOptions{}
+	}
+	deets := &PubDetails{Topic: topic, Data: payload, Priority: options.Priority, Key: options.Key}
+	if len(options.Headers) > 0 {
+		//copied so the encryption headers do not end up in the map of the caller
+		deets.Headers = make(map[string]string, len(options.Headers))
+		for key, value := range options.Headers {
+			deets.Headers[key] = value
+		}
+	}
+	keyID := options.EncryptionKeyID
+	if len(keyID) == 0 {
+		keyID = client.EncryptionKeyID
+	}
+	if len(keyID) > 0 {
+		err := client.encrypt(deets, keyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deets, nil
+}
@@ -0,0 +1,132 @@
+package simp_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//publishes fail with this once Drain was called
+var ErrDraining = errors.New("client is draining")
+
+//the errors which occurred while draining, in the order they happened
+type DrainError struct {
+	Errs []error
+}
+
+func (err *DrainError) Error() string {
+	messages := make([]string, 0, len(err.Errs))
+	for _, e := range err.Errs {
+		messages = append(messages, e.Error())
+	}
+	return "draining failed: " + strings.Join(messages, "; ")
+}
+
+//errors.Is matches any of the errors, Unwrap returning all of them needs a newer go than this module
+func (err *DrainError) Is(target error) bool {
+	for _, e := range err.Errs {
+		if errors.Is(e, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//errors.As finds the first of the errors matching target
+func (err *DrainError) As(target interface{}) bool {
+	for _, e := range err.Errs {
+		if errors.As(e, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//closes the client gracefully: new publishes fail with ErrDraining, the ones past that check are let
+//through, the batch being collected is sent, outstanding publishes, commits, acks, fetches and subscription
+//requests are waited for, every subscription is removed from the broker, the broker is told with a
+//disconnect frame and the client is closed. pull subscriptions are durable and
+//stay at the broker. the client is closed even when ctx ends early, the errors along the way are
+//returned as a DrainError
+func (client *SimpClient) Drain(ctx context.Context) error {
+	client.mu.Lock()
+	if client.state == StateClosed || client.conn == nil {
+		client.mu.Unlock()
+		return ErrClosed
+	}
+	client.draining = true
+	client.mu.Unlock()
+	var errs []error
+	//publishes which got past the draining check are handed over before the batch is sent
+	err := client.waitUntil(ctx, "publishes still being handed over", func() int {
+		return int(client.publishing)
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	client.batchMu.Lock()
+	if client.batch != nil {
+		client.batch.timer.Stop()
+		client.sendBatch(client.batch)
+		client.batch = nil
+	}
+	client.batchMu.Unlock()
+	err = client.waitForAcks(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	client.mu.Lock()
+	topics := make([]string, 0, len(client.subscriptions))
+	for topic := range client.subscriptions {
+		topics = append(topics, topic)
+	}
+	client.mu.Unlock()
+	for _, topic := range topics {
+		err = client.UnSubscribeCtx(ctx, topic)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err = client.send(&SimpData{Type: disconnect, ID: newID()})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to say goodbye to the broker: %w", err))
+	}
+	client.Close()
+	if len(errs) > 0 {
+		return &DrainError{Errs: errs}
+	}
+	return nil
+}
+
+//blocking, waits until nothing waits for the broker, publishes, fetches and subscriptions alike, and the
+//Outbox is empty, or ctx ends
+func (client *SimpClient) waitForAcks(ctx context.Context) error {
+	return client.waitUntil(ctx, "requests still waiting for the broker", func() int {
+		pending := len(client.waitingForPubAck) + len(client.waitingForBatch) + len(client.waitingForFetch) + len(client.waitingForSubUnSub)
+		if client.Outbox != nil {
+			pending += client.Outbox.Len()
+		}
+		return pending
+	})
+}
+
+//blocking, waits until pending, which is called with the lock held, returns 0 or ctx ends
+func (client *SimpClient) waitUntil(ctx context.Context, what string, pending func() int) error {
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+	for {
+		client.mu.Lock()
+		left := pending()
+		client.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d %s: %w", left, what, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package simp_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//a message recieved through Fetch or SubscribeChan. acknowledge a fetched message once it is processed,
+//unacknowledged messages are fetched again in the next session of the subscription
+type Message struct {
+	Topic   string
+	Data    []byte
+	Headers map[string]string
+	Offset  uint64 //position of the message in the pull subscription
+	client  *SimpClient
+}
+
+//acknowledges this message and every message fetched before it on the same subscription
+func (message *Message) Ack() error {
+	if message.client == nil {
+		return fmt.Errorf("only fetched messages can be acknowledged")
+	}
+	return message.client.Ack(message.Topic, message.Offset)
+}
+
+//messages recieved for a fetch request until the broker ends it
+type fetchRequest struct {
+	messages []*Message
+	done     chan bool
+	err      error //set when the broker refused the request
+}
+
+//creates or resumes the durable pull subscription of this client's id on the topic, the broker holds
+//messages published to the topic until they are fetched with Fetch and acknowledged, even while this
+//client is disconnected, so a worker can drain the queue in batches. a resumed subscription continues
+//after the last acknowledged message. call UnSubscribe to delete it along with its messages
+func (client *SimpClient) SubscribePull(topic string) error {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.SubscribePullCtx(ctx, topic)
+}
+
+//SubscribePull which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) SubscribePullCtx(ctx context.Context, topic string) error {
+	client.mu.Lock()
+	_, alreadySubscribed := client.pulls[topic]
+	client.mu.Unlock()
+	if alreadySubscribed {
+		return fmt.Errorf("already subscribed to topic %s for pulling", topic)
+	}
+	deets := &SubDetails{Topic: topic, Pull: true}
+	err := client.sendSubUnSub(ctx, sub, deets)
+	if err != nil {
+		if ctx.Err() != nil {
+			client.cancelSubscription(deets)
+		}
+		return fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+	}
+	client.mu.Lock()
+	client.pulls[topic] = true
+	client.mu.Unlock()
+	return nil
+}
+
+//fetches up to maxMessages from the pull subscription on the topic, waits up to maxWait for at least one
+//message to arrive, returns an empty slice if none did. if ctx ends first the messages recieved so far are
+//returned with the ctx error, messages of the request arriving later are delivered again in the next session
+func (client *SimpClient) Fetch(ctx context.Context, subscription string, maxMessages uint, maxWait time.Duration) ([]*Message, error) {
+	client.mu.Lock()
+	_, subscribed := client.pulls[subscription]
+	client.mu.Unlock()
+	if !subscribed {
+		return nil, fmt.Errorf("not subscribed to topic %s for pulling, call SubscribePull first", subscription)
+	}
+	if maxMessages == 0 {
+		return []*Message{}, nil
+	}
+	id := newID()
+	payload, err := (&FetchDetails{Topic: subscription, Max: maxMessages, MaxWait: maxWait.Milliseconds()}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	request := &fetchRequest{messages: make([]*Message, 0, maxMessages), done: make(chan bool)}
+	client.mu.Lock()
+	client.waitingForFetch[id] = request
+	client.mu.Unlock()
+	defer func() {
+		client.mu.Lock()
+		delete(client.waitingForFetch, id)
+		client.mu.Unlock()
+	}()
+	err = client.send(&SimpData{Type: fetch, ID: id, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-request.done:
+		return request.messages, request.err
+	case <-ctx.Done():
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return request.messages, ctx.Err()
+	}
+}
+
+//acknowledges the message at offset and every earlier message of the pull subscription on the topic,
+//completes when the broker acknowledges it or fails after the OperationTimeout
+func (client *SimpClient) Ack(topic string, offset uint64) error {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	return client.AckCtx(ctx, topic, offset)
+}
+
+//Ack which gives up with the error of ctx when it ends before the acknowledgement
+func (client *SimpClient) AckCtx(ctx context.Context, topic string, offset uint64) error {
+	id := newID()
+	payload, err := (&FetchDetails{Topic: topic, Offset: offset}).Marshal()
+	if err != nil {
+		return err
+	}
+	return client.request(ctx, client.waitingForPubAck, &SimpData{Type: ack, ID: id, Payload: payload})
+}
+
+//handles a fetched message or the end of a fetch request from the read loop
+func (client *SimpClient) handleFetchData(data *SimpData) {
+	var deets *PubDetails
+	if data.Type == fetchMsg {
+		var err error
+		deets, err = data.GetPubDetails()
+		if err != nil {
+			fmt.Println("unable to get fetched message details", err)
+			return
+		}
+		err = client.decrypt(deets)
+		if err != nil {
+			//the broker moved its cursor past it, the error carries the offset to ack it with
+			decryptionErr := &DecryptionError{}
+			if errors.As(err, &decryptionErr) {
+				decryptionErr.Offset = deets.Offset
+			}
+			client.decryptionFailed(err)
+			return
+		}
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	request, waiting := client.waitingForFetch[data.ID]
+	if !waiting {
+		return
+	}
+	if data.Type == fetchEnd {
+		close(request.done)
+		return
+	}
+	request.messages = append(request.messages, &Message{Topic: deets.Topic, Data: deets.Data, Headers: deets.Headers, Offset: deets.Offset, client: client})
+}
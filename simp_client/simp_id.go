@@ -0,0 +1,78 @@
+package simp_client
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+//crockford's base32, ids sort the same as text and as time
+const idAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//generates ULIDs, 48 bits of milliseconds followed by 80 random bits encoded in 26 characters.
+//ids of the same millisecond increment the random bits, so ids of a process are unique and increasing
+//and ids of different processes practically never collide. client and broker share the format
+type idGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+var ids = &idGenerator{}
+
+//unique id for a request or a message
+func newID() string {
+	return ids.next()
+}
+
+func (gen *idGenerator) next() string {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms > gen.lastMs {
+		gen.lastMs = ms
+		_, err := rand.Read(gen.entropy[:])
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		//same millisecond or the clock went back, keep increasing from the last id
+		i := len(gen.entropy) - 1
+		for ; i >= 0; i-- {
+			gen.entropy[i]++
+			if gen.entropy[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			gen.lastMs++
+		}
+	}
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(gen.lastMs >> (40 - 8*i))
+	}
+	copy(id[6:], gen.entropy[:])
+	return encodeID(id)
+}
+
+//encodes the 128 bits as 26 base32 characters, the first carries the 3 highest bits
+func encodeID(id [16]byte) string {
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		//5 bits ending at bit position 5*(25-i) from the end
+		shift := uint(5 * (25 - i))
+		var value byte
+		for b := uint(0); b < 5; b++ {
+			bit := shift + b
+			if bit >= 128 {
+				break
+			}
+			if id[15-bit/8]&(1<<(bit%8)) != 0 {
+				value |= 1 << b
+			}
+		}
+		out[i] = idAlphabet[value]
+	}
+	return string(out)
+}
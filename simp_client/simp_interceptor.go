@@ -0,0 +1,167 @@
+package simp_client
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+//sends the message, the last link of the chain of PublishInterceptors
+type PublishHandler func(ctx context.Context, message *Message) error
+
+//wraps every publish of the client like a grpc interceptor, it may change the topic, payload and headers
+//of the message, fail the publish without calling next, or time next to observe latency. the chain
+//of Publish completes with the broker's acknowledgement, those of PublishAsync, PublishBuffered and
+//transactions once the message is sent or queued. encryption happens after the chain
+type PublishInterceptor func(ctx context.Context, message *Message, next PublishHandler) error
+
+//hands the message to the listener or channel, the last link of the chain of DeliverInterceptors
+type DeliverHandler func(message *Message) error
+
+//wraps every delivery of a message to a listener or channel of a subscription, it may change the
+//payload and headers, skip the delivery by returning an error without calling next, or time next.
+//every listener of a topic gets its own copy of the message
+type DeliverInterceptor func(message *Message, next DeliverHandler) error
+
+//runs the message through the PublishInterceptors, first one outermost, and hands the result to final,
+//fails once the client is draining
+func (client *SimpClient) intercept(ctx context.Context, topic string, payload []byte, options *PubOptions, final func(ctx context.Context, deets *PubDetails) error) error {
+	//counted under the lock Drain sets draining with, so Drain waits for every publish it let through
+	client.mu.Lock()
+	if client.draining {
+		client.mu.Unlock()
+		return ErrDraining
+	}
+	client.publishing++
+	client.mu.Unlock()
+	defer func() {
+		client.mu.Lock()
+		client.publishing--
+		client.mu.Unlock()
+	}()
+	if options == nil {
+		options = &PubOptions{}
+	}
+	handler := func(ctx context.Context, message *Message) error {
+		intercepted := *options
+		intercepted.Headers = message.Headers
+		deets, err := client.pubDetails(message.Topic, message.Data, &intercepted)
+		if err != nil {
+			return err
+		}
+		return final(ctx, deets)
+	}
+	for i := len(client.PublishInterceptors) - 1; i >= 0; i-- {
+		interceptor, next := client.PublishInterceptors[i], handler
+		handler = func(ctx context.Context, message *Message) error {
+			return interceptor(ctx, message, next)
+		}
+	}
+	return handler(ctx, &Message{Topic: topic, Data: payload, Headers: copyHeaders(options.Headers)})
+}
+
+//runs the message through the DeliverInterceptors, first one outermost, and hands the result to final,
+//an error of the chain is logged and the message is not delivered
+func (client *SimpClient) interceptDelivery(message *Message, final DeliverHandler) {
+	if len(client.DeliverInterceptors) == 0 {
+		final(message)
+		return
+	}
+	handler := final
+	for i := len(client.DeliverInterceptors) - 1; i >= 0; i-- {
+		interceptor, next := client.DeliverInterceptors[i], handler
+		handler = func(message *Message) error {
+			return interceptor(message, next)
+		}
+	}
+	copied := *message
+	copied.Headers = copyHeaders(message.Headers)
+	err := handler(&copied)
+	if err != nil {
+		fmt.Printf("[%s] message on %s not delivered: %v\n", client.Id, message.Topic, err)
+	}
+}
+
+//never nil so interceptors can add headers right away
+func copyHeaders(headers map[string]string) map[string]string {
+	copied := make(map[string]string, len(headers))
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+//PublishInterceptor printing every publish with its latency and outcome
+func LogPublish(ctx context.Context, message *Message, next PublishHandler) error {
+	start := time.Now()
+	err := next(ctx, message)
+	fmt.Printf("published %d bytes to %s in %v, error: %v\n", len(message.Data), message.Topic, time.Since(start), err)
+	return err
+}
+
+//DeliverInterceptor printing every delivery with the time the listener took
+func LogDelivery(message *Message, next DeliverHandler) error {
+	start := time.Now()
+	err := next(message)
+	fmt.Printf("delivered %d bytes from %s in %v, error: %v\n", len(message.Data), message.Topic, time.Since(start), err)
+	return err
+}
+
+//counts publishes and deliveries and sums their latency, add its Publish and Deliver to the interceptors
+//of the client and read the counts with Snapshot
+type Metrics struct {
+	published, publishFailures, publishNanos   uint64
+	delivered, deliveryFailures, deliveryNanos uint64
+}
+
+//counts of a Metrics at one point in time
+type MetricsSnapshot struct {
+	Published        uint64
+	PublishFailures  uint64
+	Delivered        uint64
+	DeliveryFailures uint64
+	//averages over the successful and failed ones
+	PublishLatency  time.Duration
+	DeliveryLatency time.Duration
+}
+
+func (metrics *Metrics) Publish(ctx context.Context, message *Message, next PublishHandler) error {
+	start := time.Now()
+	err := next(ctx, message)
+	atomic.AddUint64(&metrics.publishNanos, uint64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&metrics.publishFailures, 1)
+	} else {
+		atomic.AddUint64(&metrics.published, 1)
+	}
+	return err
+}
+
+func (metrics *Metrics) Deliver(message *Message, next DeliverHandler) error {
+	start := time.Now()
+	err := next(message)
+	atomic.AddUint64(&metrics.deliveryNanos, uint64(time.Since(start)))
+	if err != nil {
+		atomic.AddUint64(&metrics.deliveryFailures, 1)
+	} else {
+		atomic.AddUint64(&metrics.delivered, 1)
+	}
+	return err
+}
+
+func (metrics *Metrics) Snapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Published:        atomic.LoadUint64(&metrics.published),
+		PublishFailures:  atomic.LoadUint64(&metrics.publishFailures),
+		Delivered:        atomic.LoadUint64(&metrics.delivered),
+		DeliveryFailures: atomic.LoadUint64(&metrics.deliveryFailures),
+	}
+	if publishes := snapshot.Published + snapshot.PublishFailures; publishes > 0 {
+		snapshot.PublishLatency = time.Duration(atomic.LoadUint64(&metrics.publishNanos) / publishes)
+	}
+	if deliveries := snapshot.Delivered + snapshot.DeliveryFailures; deliveries > 0 {
+		snapshot.DeliveryLatency = time.Duration(atomic.LoadUint64(&metrics.deliveryNanos) / deliveries)
+	}
+	return snapshot
+}
@@ -0,0 +1,423 @@
+package simp_client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//result of a publish which completes later, resolved when the broker acknowledges the message or it fails
+type PublishFuture struct {
+	done chan struct{}
+	err  error
+	once sync.Once
+}
+
+func newPublishFuture() *PublishFuture {
+	return &PublishFuture{done: make(chan struct{})}
+}
+
+func (future *PublishFuture) resolve(err error) {
+	future.once.Do(func() {
+		future.err = err
+		close(future.done)
+	})
+}
+
+//closed once the publish completed
+func (future *PublishFuture) Done() <-chan struct{} {
+	return future.done
+}
+
+//error of the completed publish, nil while it is not completed
+func (future *PublishFuture) Err() error {
+	select {
+	case <-future.done:
+		return future.err
+	default:
+		return nil
+	}
+}
+
+//waits for the publish to complete and returns its error, or the error of ctx if it ends first
+//in which case the publish still goes on
+func (future *PublishFuture) Wait(ctx context.Context) error {
+	select {
+	case <-future.done:
+		return future.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//queue of publishes waiting to be sent, in order
+type Outbox interface {
+	//adds the publish at the end
+	Push(data *SimpData) error
+	//first publish or nil when empty
+	Peek() (*SimpData, error)
+	//removes the first publish
+	Pop() error
+	Len() int
+}
+
+//what happens to a publish when the outbox holds OutboxSize publishes
+type OverflowPolicy int
+
+const (
+	//the publish waits for room
+	OverflowBlock OverflowPolicy = iota
+	//the publish fails with ErrOutboxFull
+	OverflowError
+	//the oldest queued publish is dropped, its future fails with ErrDropped
+	OverflowDropOldest
+)
+
+var (
+	ErrOutboxFull = errors.New("outbox is full")
+	ErrDropped    = errors.New("publish dropped from a full outbox")
+)
+
+//Outbox held in memory, queued publishes are lost when the process exits
+type MemoryOutbox struct {
+	queue []*SimpData
+}
+
+func (outbox *MemoryOutbox) Push(data *SimpData) error {
+	outbox.queue = append(outbox.queue, data)
+	return nil
+}
+
+func (outbox *MemoryOutbox) Peek() (*SimpData, error) {
+	if len(outbox.queue) == 0 {
+		return nil, nil
+	}
+	return outbox.queue[0], nil
+}
+
+func (outbox *MemoryOutbox) Pop() error {
+	if len(outbox.queue) == 0 {
+		return nil
+	}
+	outbox.queue[0] = nil
+	outbox.queue = outbox.queue[1:]
+	return nil
+}
+
+func (outbox *MemoryOutbox) Len() int {
+	return len(outbox.queue)
+}
+
+//Outbox keeping every queued publish in its own file of a directory, publishes still queued when the
+//process exits are sent after the next ConnectToServer, they have no future to report to
+type FileOutbox struct {
+	dir string
+	//sequence numbers of the queued files in order
+	queue []uint64
+	next  uint64
+}
+
+//opens the outbox in the directory, creating it if needed, publishes left by an earlier process are queued first
+func NewFileOutbox(dir string) (*FileOutbox, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	outbox := &FileOutbox{dir: dir}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		outbox.queue = append(outbox.queue, sequence)
+		if sequence >= outbox.next {
+			outbox.next = sequence + 1
+		}
+	}
+	sort.Slice(outbox.queue, func(i, j int) bool {
+		return outbox.queue[i] < outbox.queue[j]
+	})
+	return outbox, nil
+}
+
+func (outbox *FileOutbox) file(sequence uint64) string {
+	return filepath.Join(outbox.dir, fmt.Sprintf("%020d.json", sequence))
+}
+
+func (outbox *FileOutbox) Push(data *SimpData) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	//written aside and renamed so a crash never leaves half a publish in the queue
+	file := outbox.file(outbox.next)
+	err = writeSynced(file+".tmp", bytes)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file+".tmp", file)
+	if err != nil {
+		return err
+	}
+	outbox.queue = append(outbox.queue, outbox.next)
+	outbox.next++
+	return nil
+}
+
+//writes the file and syncs it to disk, a rename after it never leaves an empty or partial file behind
+func writeSynced(name string, bytes []byte) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(bytes)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (outbox *FileOutbox) Peek() (*SimpData, error) {
+	if len(outbox.queue) == 0 {
+		return nil, nil
+	}
+	bytes, err := os.ReadFile(outbox.file(outbox.queue[0]))
+	if err != nil {
+		return nil, err
+	}
+	data := &SimpData{}
+	err = json.Unmarshal(bytes, data)
+	return data, err
+}
+
+func (outbox *FileOutbox) Pop() error {
+	if len(outbox.queue) == 0 {
+		return nil
+	}
+	err := os.Remove(outbox.file(outbox.queue[0]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	outbox.queue = outbox.queue[1:]
+	return nil
+}
+
+func (outbox *FileOutbox) Len() int {
+	return len(outbox.queue)
+}
+
+//queues the publish in the Outbox, it is sent in order once the client is connected, the future resolves
+//when the broker acknowledges it. publishes are queued while the client reconnects, so they are not lost
+//when the broker restarts
+func (client *SimpClient) PublishBuffered(topic string, payload []byte, options *PubOptions) (*PublishFuture, error) {
+	return client.PublishBufferedCtx(context.Background(), topic, payload, options)
+}
+
+//PublishBuffered which stops waiting for room in a full outbox with the error of ctx when it ends
+func (client *SimpClient) PublishBufferedCtx(ctx context.Context, topic string, payload []byte, options *PubOptions) (*PublishFuture, error) {
+	if client.Outbox == nil {
+		return nil, errors.New("SimpClient has no Outbox")
+	}
+	var future *PublishFuture
+	err := client.intercept(ctx, topic, payload, options, func(ctx context.Context, deets *PubDetails) (err error) {
+		future, err = client.enqueue(ctx, deets)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return future, nil
+}
+
+//queues the publish in the Outbox, applying the OutboxOverflow when it is full
+func (client *SimpClient) enqueue(ctx context.Context, deets *PubDetails) (*PublishFuture, error) {
+	payload, err := json.Marshal(deets)
+	if err != nil {
+		return nil, err
+	}
+	data := &SimpData{Type: pub, ID: newID(), Payload: payload}
+	future := newPublishFuture()
+	size := client.OutboxSize
+	if size == 0 {
+		size = 1000
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for uint(client.Outbox.Len()) >= size {
+		switch client.OutboxOverflow {
+		case OverflowError:
+			return nil, ErrOutboxFull
+		case OverflowDropOldest:
+			dropped, err := client.Outbox.Peek()
+			if err != nil {
+				return nil, err
+			}
+			if dropped != nil && dropped.ID == client.outboxSending {
+				//already on its way to the broker, there is room once it is acknowledged
+				err = client.waitForOutbox(ctx)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			err = client.Outbox.Pop()
+			if err != nil {
+				return nil, err
+			}
+			if dropped != nil && client.futures[dropped.ID] != nil {
+				client.futures[dropped.ID].resolve(ErrDropped)
+				delete(client.futures, dropped.ID)
+			}
+		default:
+			err = client.waitForOutbox(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = client.Outbox.Push(data)
+	if err != nil {
+		return nil, err
+	}
+	client.futures[data.ID] = future
+	client.outboxCond.Broadcast()
+	return future, nil
+}
+
+//waits until the pump takes a publish out of the Outbox or ctx ends, must be called with the lock held
+func (client *SimpClient) waitForOutbox(ctx context.Context) error {
+	if client.state == StateClosed {
+		return ErrDisconnected
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	woken := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.mu.Lock()
+			client.outboxCond.Broadcast()
+			client.mu.Unlock()
+		case <-woken:
+		}
+	}()
+	client.outboxCond.Wait()
+	close(woken)
+	return nil
+}
+
+//blocking, sends the queued publishes in order whenever the client is connected until it is closed,
+//one at a time as each leaves the Outbox only once the broker acknowledged it
+func (client *SimpClient) pumpOutbox() {
+	for {
+		client.mu.Lock()
+		for (client.Outbox.Len() == 0 || client.state != StateConnected || client.restoring) && client.state != StateClosed {
+			client.outboxCond.Wait()
+		}
+		if client.state == StateClosed {
+			//the futures of publishes still queued fail, a FileOutbox keeps them for the next connect
+			for id, future := range client.futures {
+				future.resolve(ErrDisconnected)
+				delete(client.futures, id)
+			}
+			client.mu.Unlock()
+			return
+		}
+		data, err := client.Outbox.Peek()
+		if err != nil || data == nil {
+			fmt.Printf("[%s] unable to read the outbox, dropping its first publish: %v\n", client.Id, err)
+			client.Outbox.Pop()
+			client.mu.Unlock()
+			continue
+		}
+		future := client.futures[data.ID]
+		ch := make(chan error, 1)
+		client.waitingForPubAck[data.ID] = ch
+		client.outboxSending = data.ID
+		conn := client.conn
+		client.mu.Unlock()
+		err = conn.respond(data)
+		written := err == nil
+		if written {
+			//the publish stays first in the Outbox until the broker acknowledges it, a lost connection
+			//fails it with ErrDisconnected and it is sent again on the next connection, an ack which
+			//does not arrive within the OperationTimeout has it sent again
+			err = client.awaitOutboxAck(ch)
+		}
+		client.mu.Lock()
+		delete(client.waitingForPubAck, data.ID)
+		client.outboxSending = ""
+		if errors.Is(err, ErrDisconnected) || errors.Is(err, context.DeadlineExceeded) {
+			client.mu.Unlock()
+			continue
+		}
+		if err != nil && !written && !errors.Is(err, ErrFrameTooLarge) {
+			//the connection is failing, the publish stays first in line for the next connection
+			if client.conn == conn && client.state == StateConnected {
+				client.outboxCond.Wait()
+			}
+			client.mu.Unlock()
+			continue
+		}
+		//acknowledged, refused by the broker or too large to ever fit, the publishes behind it go on
+		client.Outbox.Pop()
+		delete(client.futures, data.ID)
+		client.outboxCond.Broadcast()
+		client.mu.Unlock()
+		if future != nil {
+			future.resolve(err)
+		}
+	}
+}
+
+//waits for the ack of the publish the pump sent, fails after the OperationTimeout
+func (client *SimpClient) awaitOutboxAck(ch chan error) error {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//resolves the future of a sent publish once the broker answers, the connection is lost or the
+//OperationTimeout passes
+func (client *SimpClient) awaitAck(id string, ch chan error, future *PublishFuture) {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	var err error
+	select {
+	case err = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.mu.Lock()
+	delete(client.waitingForPubAck, id)
+	client.unacked.remove(id)
+	client.mu.Unlock()
+	if future != nil {
+		future.resolve(err)
+	}
+}
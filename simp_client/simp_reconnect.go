@@ -0,0 +1,279 @@
+package simp_client
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+//state of the client's connection to the broker
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+	//the connection was lost and the client is trying to connect again
+	StateReconnecting
+	//Close was called
+	StateClosed
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "disconnected"
+}
+
+var (
+	//requests waiting for the broker fail with this when the connection is lost
+	ErrDisconnected = errors.New("connection to the broker was lost")
+	//subscriptions end with this when Close is called
+	ErrClosed = errors.New("client was closed")
+)
+
+//current state of the connection to the broker, use it to report health
+func (client *SimpClient) State() ConnectionState {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.state
+}
+
+func (client *SimpClient) setState(state ConnectionState) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.state = state
+}
+
+//sends the data over the current connection
+func (client *SimpClient) send(data *SimpData) error {
+	client.mu.Lock()
+	conn := client.conn
+	client.mu.Unlock()
+	if conn == nil {
+		return ErrDisconnected
+	}
+	return conn.respond(data)
+}
+
+//called by the read loop of the connection when it fails, unless the client was closed
+//the requests waiting for the broker are failed and reconnecting starts with AutoReconnect
+func (client *SimpClient) connectionLost(simpConn *SimpServerConn, err error) {
+	client.mu.Lock()
+	if client.state == StateClosed || client.conn != simpConn {
+		client.mu.Unlock()
+		return
+	}
+	if client.AutoReconnect {
+		client.state = StateReconnecting
+	} else {
+		client.state = StateDisconnected
+	}
+	client.outboxCond.Broadcast()
+	client.failPending(client.AutoReconnect && client.ResendPending)
+	if !client.AutoReconnect {
+		client.endSubscriptions(ErrDisconnected)
+	}
+	client.mu.Unlock()
+	client.ConnectedToServer = false
+	simpConn.NetConn.Close()
+	fmt.Printf("[%s] lost connection to broker: %v\n", client.Id, err)
+	if client.OnDisconnect != nil {
+		client.OnDisconnect(err)
+	}
+	if client.AutoReconnect {
+		go client.reconnect()
+	}
+}
+
+//fails every request waiting for the broker with ErrDisconnected, publishes are kept to be resent
+//when keepPublishes is set, must be called with the lock held
+func (client *SimpClient) failPending(keepPublishes bool) {
+	for id, ch := range client.waitingForPubAck {
+		if client.unacked.has(id) && keepPublishes {
+			continue
+		}
+		select {
+		case ch <- ErrDisconnected:
+		default:
+		}
+	}
+	for _, ch := range client.waitingForSubUnSub {
+		select {
+		case ch <- ErrDisconnected:
+		default:
+		}
+	}
+	for id, request := range client.waitingForFetch {
+		request.err = ErrDisconnected
+		close(request.done)
+		delete(client.waitingForFetch, id)
+	}
+	//batches are never resent
+	for id, pending := range client.waitingForBatch {
+		pending.resolve(ErrDisconnected)
+		delete(client.waitingForBatch, id)
+	}
+}
+
+//ends every subscription with the error, their listeners get no more messages and their channels
+//are closed, must be called with the lock held
+func (client *SimpClient) endSubscriptions(err error) {
+	for topic, subscription := range client.subscriptions {
+		subscription.end(err)
+		delete(client.subscriptions, topic)
+	}
+}
+
+//delay before the attempt, doubles with every attempt up to MaxReconnectDelay, the delay is
+//jittered between half and all of it so clients of a restarted broker do not come back at once
+func (client *SimpClient) reconnectDelay(attempt uint) time.Duration {
+	delay, maxDelay := client.ReconnectBackoff, client.MaxReconnectDelay
+	if delay <= 0 {
+		delay = time.Millisecond * 100
+	}
+	if maxDelay <= 0 {
+		maxDelay = time.Second * 30
+	}
+	for i := uint(0); i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+//blocking, tries to connect again until it succeeds, the client is closed or MaxReconnects is reached
+func (client *SimpClient) reconnect() {
+	for attempt := uint(0); client.MaxReconnects == 0 || attempt < client.MaxReconnects; attempt++ {
+		select {
+		case <-time.After(client.reconnectDelay(attempt)):
+		case <-client.connectedToServer:
+			return
+		}
+		simpConn, err := client.dial()
+		if err != nil {
+			fmt.Printf("[%s] reconnect attempt %d failed: %v\n", client.Id, attempt+1, err)
+			continue
+		}
+		client.mu.Lock()
+		if client.state == StateClosed {
+			client.mu.Unlock()
+			simpConn.NetConn.Close()
+			return
+		}
+		client.conn = simpConn
+		client.state = StateConnected
+		client.restoring = true
+		client.mu.Unlock()
+		client.ConnectedToServer = true
+		client.TookOverSession = simpConn.Session.TookOver
+		client.InheritedTopics = simpConn.Session.Topics
+		fmt.Printf("[%s] reconnected to broker %s\n", client.Id, client.SimpBrokerHost)
+		go client.readLoop(simpConn)
+		client.restore()
+		client.mu.Lock()
+		client.restoring = false
+		client.outboxCond.Broadcast()
+		client.mu.Unlock()
+		if client.OnReconnect != nil {
+			client.OnReconnect()
+		}
+		return
+	}
+	fmt.Printf("[%s] gave up reconnecting after %d attempts\n", client.Id, client.MaxReconnects)
+	client.mu.Lock()
+	if client.state == StateReconnecting {
+		client.state = StateDisconnected
+		client.failPending(false)
+		client.endSubscriptions(ErrDisconnected)
+	}
+	client.mu.Unlock()
+}
+
+//subscribes again to every topic of the client and resends the publishes waiting for their ack,
+//the Outbox is flushed only afterwards so its publishes follow the resent ones
+func (client *SimpClient) restore() {
+	client.mu.Lock()
+	subscriptions := make([]*subscription, 0, len(client.subscriptions))
+	for _, subscription := range client.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	pulls := make([]string, 0, len(client.pulls))
+	for topic := range client.pulls {
+		pulls = append(pulls, topic)
+	}
+	unacked := client.unacked.inOrder()
+	client.mu.Unlock()
+	for _, subscription := range subscriptions {
+		client.resubscribe(&SubDetails{Topic: subscription.topic, Group: subscription.group, Credits: subscription.restoreCredits()})
+	}
+	for _, topic := range pulls {
+		client.resubscribe(&SubDetails{Topic: topic, Pull: true})
+	}
+	for _, data := range unacked {
+		err := client.send(data)
+		if err != nil {
+			fmt.Printf("[%s] failed to resend message %s: %v\n", client.Id, data.ID, err)
+		}
+	}
+}
+
+func (client *SimpClient) resubscribe(deets *SubDetails) {
+	ctx, cancel := client.operationContext()
+	defer cancel()
+	err := client.sendSubUnSub(ctx, sub, deets)
+	if err != nil {
+		fmt.Printf("[%s] failed to restore subscription to %s: %v\n", client.Id, deets.Topic, err)
+	}
+}
+
+//publishes waiting for their ack in the order they were sent, so a reconnect resends them in that
+//order, must be used with the client's lock held
+type pendingPublishes struct {
+	order *list.List
+	byID  map[string]*list.Element
+}
+
+func newPendingPublishes() *pendingPublishes {
+	return &pendingPublishes{order: list.New(), byID: make(map[string]*list.Element)}
+}
+
+//a publish sent again keeps its place
+func (p *pendingPublishes) add(data *SimpData) {
+	if _, ok := p.byID[data.ID]; ok {
+		return
+	}
+	p.byID[data.ID] = p.order.PushBack(data)
+}
+
+func (p *pendingPublishes) remove(id string) {
+	if element, ok := p.byID[id]; ok {
+		p.order.Remove(element)
+		delete(p.byID, id)
+	}
+}
+
+func (p *pendingPublishes) has(id string) bool {
+	_, ok := p.byID[id]
+	return ok
+}
+
+func (p *pendingPublishes) inOrder() []*SimpData {
+	publishes := make([]*SimpData, 0, p.order.Len())
+	for element := p.order.Front(); element != nil; element = element.Next() {
+		publishes = append(publishes, element.Value.(*SimpData))
+	}
+	return publishes
+}
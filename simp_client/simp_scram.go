@@ -0,0 +1,87 @@
+package simp_client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//fewest iterations the client accepts from the broker
+const minScramIterations = 4096
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+//what both sides sign, binds the proof to the client, both nonces and the salt
+func scramAuthMessage(clientID string, clientNonce string, nonce string, salt []byte, iterations int) string {
+	return strings.Join([]string{clientID, clientNonce, nonce, base64.StdEncoding.EncodeToString(salt), fmt.Sprint(iterations)}, ",")
+}
+
+func newScramNonce() (string, error) {
+	nonce := make([]byte, 18)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+//answers the broker's SCRAM-SHA-256 challenge with a proof of the secret and verifies the broker's
+//signature in the acknowledgement, so both sides know the other holds the credential
+func (sc *SimpServerConn) proveToBroker(secret string, clientNonce string, challengeData *SimpData) error {
+	challenge, err := challengeData.GetScramDetails()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(challenge.Nonce, clientNonce) || len(challenge.Nonce) == len(clientNonce) {
+		return errors.New("broker sent an invalid nonce")
+	}
+	//a low count would make the proof cheap to brute force for whoever sees it
+	if challenge.Iterations < minScramIterations {
+		return fmt.Errorf("broker asked for %d iterations, at least %d are required", challenge.Iterations, minScramIterations)
+	}
+	salted := pbkdf2.Key([]byte(secret), challenge.Salt, challenge.Iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := scramAuthMessage(sc.AuthDetails.ClientID, clientNonce, challenge.Nonce, challenge.Salt, challenge.Iterations)
+	signature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, sha256.Size)
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	payload, err := (&ScramDetails{Nonce: challenge.Nonce, Proof: proof}).Marshal()
+	if err != nil {
+		return err
+	}
+	err = respond(&SimpData{Type: authProof, Payload: payload}, sc.NetConn)
+	if err != nil {
+		return err
+	}
+	data, err := nextDataFromConnection(sc.BufferSize, sc.reader())
+	if err != nil {
+		return err
+	}
+	if data.Type == nack {
+		return refusedAuthentication(data)
+	}
+	if data.Type != authAck {
+		return fmt.Errorf("failed to authenticate from client because no auth ack recieved")
+	}
+	final, err := data.GetScramDetails()
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(final.ServerSignature, scramHMAC(scramHMAC(salted, "Server Key"), authMessage)) {
+		return errors.New("broker failed to prove it knows the credential")
+	}
+	return nil
+}
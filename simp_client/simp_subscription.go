@@ -0,0 +1,346 @@
+package simp_client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//handle of one listener or channel of a topic, see SubscribeListener and SubscribeChan
+type Subscription interface {
+	//ends this subscription, its channel is closed, the broker is told once the last one of the topic ends
+	Unsubscribe() error
+	//why the subscription ended, ErrDisconnected or ErrClosed, nil while it is active or after Unsubscribe
+	Err() error
+	//messages dropped because the channel was full
+	Dropped() uint64
+}
+
+//the subscription of the client to a topic at the broker, shared by every local subscription of the topic.
+//every local subscription gets the messages on a queue of its own drained by its own goroutine, so a slow
+//listener stalls neither the connection's read loop nor the other listeners of the topic.
+//the broker sends at most as many messages as the subscription has credits for, a message grants its
+//credit back once every local subscription consumed it, so the broker delivers at the pace of the
+//slowest listener and no queue ever holds more than the window
+type subscription struct {
+	client *SimpClient
+	topic  string
+	//group of a shared subscription
+	group string
+	//listeners and channels of the topic, guarded by mu
+	locals []*localSubscription
+	mu     sync.Mutex
+	//set while the broker is told to unsubscribe, closed once it answered. joining waits for it, guarded by mu
+	unsubscribing chan bool
+	//closed once the broker acknowledged the subscription
+	subscribed chan bool
+	//closed when the subscription ends
+	done    chan bool
+	endOnce sync.Once
+	//why the subscription ended, set before done is closed
+	err error
+	//guards the credits below
+	creditMu sync.Mutex
+	//messages the broker may have in flight to this subscription
+	window uint
+	//largest window the subscription may grow to
+	maxWindow uint
+	//messages recieved and not yet consumed by every local subscription
+	inFlight uint
+	//messages consumed since credits were last granted
+	consumed uint
+}
+
+//a message on its way to the local subscriptions, consumed once none of them has it left, accessed atomically
+type delivery struct {
+	message   *Message
+	remaining int32
+}
+
+//a listener or channel recieving the messages of a subscription
+type localSubscription struct {
+	parent *subscription
+	//called with every message unless out is set
+	handler func(*Message)
+	//messages go to this channel instead of the handler when set
+	out chan Message
+	//messages waiting for this local subscription, it holds the whole window
+	queue chan *delivery
+	//closed once the local subscription is removed from its subscription
+	stop chan bool
+	mu   sync.Mutex
+	//set once the local subscription ended, guarded by mu
+	ended bool
+	err   error
+	//messages not sent to out because it was full, accessed atomically
+	dropped uint64
+}
+
+func newSubscription(client *SimpClient, topic string) *subscription {
+	prefetch, maxPrefetch := client.Prefetch, client.MaxPrefetch
+	if prefetch == 0 {
+		prefetch = 64
+	}
+	if maxPrefetch < prefetch {
+		maxPrefetch = prefetch
+	}
+	return &subscription{
+		client:     client,
+		topic:      topic,
+		subscribed: make(chan bool),
+		done:       make(chan bool),
+		window:     prefetch,
+		maxWindow:  maxPrefetch,
+	}
+}
+
+//adds a local subscription recieving the messages from now on, while the subscription is unsubscribing
+//nothing is added and the channel closed once the broker answered is returned instead
+func (sub *subscription) add(handler func(*Message), out chan Message) (*localSubscription, chan bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.unsubscribing != nil {
+		return nil, sub.unsubscribing
+	}
+	local := &localSubscription{parent: sub, handler: handler, out: out, queue: make(chan *delivery, sub.maxWindow), stop: make(chan bool)}
+	sub.locals = append(sub.locals, local)
+	go local.run()
+	return local, nil
+}
+
+//removes the local subscription, when it was the last one and last is set the subscription turns
+//unsubscribing and true is returned, the caller tells the broker then
+func (sub *subscription) remove(local *localSubscription, last bool) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	for i, other := range sub.locals {
+		if other == local {
+			sub.locals = append(sub.locals[:i], sub.locals[i+1:]...)
+			close(local.stop)
+			break
+		}
+	}
+	if !last || len(sub.locals) > 0 || sub.unsubscribing != nil {
+		return false
+	}
+	select {
+	case <-sub.done:
+		return false
+	default:
+	}
+	sub.unsubscribing = make(chan bool)
+	return true
+}
+
+//turns the subscription unsubscribing whatever local subscriptions it has, false if it already is
+func (sub *subscription) beginUnsubscribe() bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.unsubscribing != nil {
+		return false
+	}
+	sub.unsubscribing = make(chan bool)
+	return true
+}
+
+//the broker answered the unsubscription, the ones waiting to join go on
+func (sub *subscription) unsubscribed() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	close(sub.unsubscribing)
+	sub.unsubscribing = nil
+}
+
+//called from the read loop, queues the message for every local subscription. the broker never exceeds
+//the granted credits so the queues have room and this does not block
+func (sub *subscription) deliver(message *Message) {
+	sub.creditMu.Lock()
+	sub.inFlight++
+	sub.creditMu.Unlock()
+	sub.mu.Lock()
+	locals := len(sub.locals)
+	d := &delivery{message: message, remaining: int32(locals)}
+	overflow := 0
+	for _, local := range sub.locals {
+		select {
+		case local.queue <- d:
+		default:
+			atomic.AddUint64(&local.dropped, 1)
+			overflow++
+		}
+	}
+	sub.mu.Unlock()
+	if locals == 0 {
+		sub.consume()
+	}
+	for i := 0; i < overflow; i++ {
+		sub.release(d)
+	}
+}
+
+//a message which never reaches the listeners, like one which failed to decrypt, still takes its place
+//in the queues so its credit is granted back in turn
+func (sub *subscription) skip() {
+	sub.deliver(nil)
+}
+
+//a local subscription is done with the message, the last one consumes it
+func (sub *subscription) release(d *delivery) {
+	if atomic.AddInt32(&d.remaining, -1) == 0 {
+		sub.consume()
+	}
+}
+
+//grants the consumed credits back once half of the window is used, a subscription whose listeners
+//keep up with the broker gets its window doubled up to maxWindow to allow more messages in flight
+func (sub *subscription) consume() {
+	sub.creditMu.Lock()
+	sub.inFlight--
+	sub.consumed++
+	if sub.consumed < (sub.window+1)/2 {
+		sub.creditMu.Unlock()
+		return
+	}
+	select {
+	case <-sub.done:
+		sub.creditMu.Unlock()
+		return
+	default:
+	}
+	grant := sub.consumed
+	if sub.inFlight == 0 && sub.window < sub.maxWindow {
+		grow := sub.window
+		if sub.window+grow > sub.maxWindow {
+			grow = sub.maxWindow - sub.window
+		}
+		sub.window += grow
+		grant += grow
+	}
+	sub.consumed = 0
+	sub.creditMu.Unlock()
+	payload, err := (&SubDetails{Topic: sub.topic, Credits: grant}).Marshal()
+	if err != nil {
+		fmt.Println("unable to grant credits", err)
+		return
+	}
+	err = sub.client.send(&SimpData{Type: credit, Payload: payload})
+	if err != nil {
+		fmt.Println("unable to grant credits", err)
+	}
+}
+
+//credits to subscribe with again after a reconnect, the messages still queued grant theirs once consumed
+func (sub *subscription) restoreCredits() uint {
+	sub.creditMu.Lock()
+	defer sub.creditMu.Unlock()
+	sub.consumed = 0
+	if sub.inFlight < sub.window {
+		return sub.window - sub.inFlight
+	}
+	return 1
+}
+
+//stops handing messages to the listeners
+func (sub *subscription) close() {
+	sub.end(nil)
+}
+
+//stops handing messages to the listeners and ends every local subscription, err tells why
+func (sub *subscription) end(err error) {
+	sub.endOnce.Do(func() {
+		sub.err = err
+		close(sub.done)
+		sub.mu.Lock()
+		locals := sub.locals
+		sub.locals = nil
+		for _, local := range locals {
+			close(local.stop)
+		}
+		sub.mu.Unlock()
+		for _, local := range locals {
+			local.end(err)
+		}
+	})
+}
+
+//blocking, hands the queued messages over until the local subscription is removed, the messages
+//left in the queue then only give their credits back
+func (local *localSubscription) run() {
+	for {
+		select {
+		case <-local.stop:
+			for {
+				select {
+				case d := <-local.queue:
+					local.parent.release(d)
+				default:
+					return
+				}
+			}
+		default:
+		}
+		select {
+		case d := <-local.queue:
+			if d.message != nil {
+				local.deliver(d.message)
+			}
+			local.parent.release(d)
+		case <-local.stop:
+		}
+	}
+}
+
+//hands the message through the DeliverInterceptors of the client
+func (local *localSubscription) deliver(message *Message) {
+	local.parent.client.interceptDelivery(message, local.handOver)
+}
+
+//a full channel drops the message rather than holding up the other listeners
+func (local *localSubscription) handOver(message *Message) error {
+	local.mu.Lock()
+	if local.ended {
+		local.mu.Unlock()
+		return nil
+	}
+	if local.out != nil {
+		select {
+		case local.out <- *message:
+		default:
+			atomic.AddUint64(&local.dropped, 1)
+		}
+		local.mu.Unlock()
+		return nil
+	}
+	local.mu.Unlock()
+	local.handler(message)
+	return nil
+}
+
+func (local *localSubscription) end(err error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if local.ended {
+		return
+	}
+	local.ended = true
+	local.err = err
+	if local.out != nil {
+		close(local.out)
+	}
+}
+
+func (local *localSubscription) Unsubscribe() error {
+	ctx, cancel := local.parent.client.operationContext()
+	defer cancel()
+	return local.parent.client.unsubscribeLocal(ctx, local)
+}
+
+func (local *localSubscription) Err() error {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	return local.err
+}
+
+func (local *localSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&local.dropped)
+}
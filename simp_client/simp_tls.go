@@ -0,0 +1,34 @@
+package simp_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+//builds a tls config for SimpClient.TLSConfig from pem files, caFile is the pool the broker's certificate
+//is verified against, system roots are used when empty, certFile and keyFile are the client certificate
+//presented to a broker requiring mutual tls, leave them empty otherwise
+func LoadTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
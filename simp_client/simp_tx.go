@@ -0,0 +1,115 @@
+package simp_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+//a group of messages published atomically, possibly to different topics,
+//messages are staged on the broker and none of them reach subscribers until Commit.
+//staged messages live in the broker's memory, they are discarded if the connection
+//drops or the broker stops before the commit is acknowledged, the transaction then fails with ErrDisconnected
+type SimpTx struct {
+	client *SimpClient
+	id     string
+	mu     sync.Mutex
+	done   bool
+	//connection the messages were staged on
+	conn *SimpServerConn
+	//messages staged so far, the broker checks it holds as many on commit
+	staged uint
+}
+
+//starts a new transaction, call Commit or Abort to finish it
+func (client *SimpClient) BeginTx() *SimpTx {
+	return &SimpTx{client: client, id: newID()}
+}
+
+//stages the payload for the topic with default options, it is published on Commit
+func (tx *SimpTx) Publish(topic string, payload []byte) error {
+	return tx.PublishWithOptions(topic, payload, nil)
+}
+
+//stages the payload for the topic using the options, it is published on Commit
+func (tx *SimpTx) PublishWithOptions(topic string, payload []byte, options *PubOptions) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return fmt.Errorf("transaction %s is already finished", tx.id)
+	}
+	return tx.client.intercept(context.Background(), topic, payload, options, func(ctx context.Context, deets *PubDetails) error {
+		payload, err := json.Marshal(deets)
+		if err != nil {
+			return err
+		}
+		conn, err := tx.connection()
+		if err != nil {
+			return err
+		}
+		err = conn.respond(&SimpData{Type: txPub, ID: tx.id, Payload: payload})
+		if err != nil {
+			return err
+		}
+		tx.staged++
+		return nil
+	})
+}
+
+//connection the transaction stages on, the first message picks the current one. once the client
+//reconnected the staged messages are gone, so the transaction fails with ErrDisconnected
+func (tx *SimpTx) connection() (*SimpServerConn, error) {
+	tx.client.mu.Lock()
+	conn := tx.client.conn
+	tx.client.mu.Unlock()
+	if conn == nil || (tx.conn != nil && tx.conn != conn) {
+		tx.done = true
+		return nil, ErrDisconnected
+	}
+	tx.conn = conn
+	return conn, nil
+}
+
+//publishes every staged message at once,
+//completes when the broker acknowledges the whole transaction or fails after the OperationTimeout
+func (tx *SimpTx) Commit() error {
+	ctx, cancel := tx.client.operationContext()
+	defer cancel()
+	return tx.CommitCtx(ctx)
+}
+
+//Commit which gives up with the error of ctx when it ends before the acknowledgement,
+//the transaction may still be committed
+func (tx *SimpTx) CommitCtx(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return fmt.Errorf("transaction %s is already finished", tx.id)
+	}
+	if tx.staged == 0 {
+		tx.done = true
+		return nil
+	}
+	_, err := tx.connection()
+	if err != nil {
+		return err
+	}
+	tx.done = true
+	payload, err := (&TxDetails{Staged: tx.staged}).Marshal()
+	if err != nil {
+		return err
+	}
+	return tx.client.request(ctx, tx.client.waitingForPubAck, &SimpData{Type: txCommit, ID: tx.id, Payload: payload})
+}
+
+//discards every staged message, nothing of the transaction is published
+func (tx *SimpTx) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return fmt.Errorf("transaction %s is already finished", tx.id)
+	}
+	tx.done = true
+	return tx.client.send(&SimpData{Type: txAbort, ID: tx.id})
+}
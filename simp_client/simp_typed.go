@@ -0,0 +1,139 @@
+package simp_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+//header telling subscribers how the payload of a TypedTopic is encoded
+const HeaderContentType = "content-type"
+
+//turns values of a TypedTopic into payloads and back
+type Codec[T any] interface {
+	//sent in the HeaderContentType of every message
+	ContentType() string
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+//Codec encoding values as json, the default of a TypedTopic
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) ContentType() string {
+	return "application/json"
+}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+//what came along with a message of a TypedTopic
+type Metadata struct {
+	Topic       string
+	ContentType string
+	Headers     map[string]string
+}
+
+//a message which could not be decoded, handed to the OnDecodeError of its TypedTopic
+type DecodeError struct {
+	Topic       string
+	ContentType string
+	Err         error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("unable to decode message on %s with content type %q: %v", err.Topic, err.ContentType, err.Err)
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+//a topic carrying values of T encoded by the Codec instead of raw payloads
+type TypedTopic[T any] struct {
+	Client *SimpClient
+	Name   string
+	Codec  Codec[T]
+	//called with a DecodeError for a message which could not be decoded, the message is skipped
+	OnDecodeError func(err error)
+}
+
+//typed view of the topic on the client, a nil codec encodes json
+func NewTypedTopic[T any](client *SimpClient, name string, codec Codec[T]) *TypedTopic[T] {
+	if codec == nil {
+		codec = JSONCodec[T]{}
+	}
+	return &TypedTopic[T]{Client: client, Name: name, Codec: codec}
+}
+
+//encodes and publishes the value, completes when the broker acknowledges it or ctx ends
+func (topic *TypedTopic[T]) Publish(ctx context.Context, value T) error {
+	return topic.PublishWithOptions(ctx, value, nil)
+}
+
+//Publish using the options, the content type is added to their headers
+func (topic *TypedTopic[T]) PublishWithOptions(ctx context.Context, value T, options *PubOptions) error {
+	data, err := topic.Codec.Encode(value)
+	if err != nil {
+		return fmt.Errorf("unable to encode message for %s: %w", topic.Name, err)
+	}
+	withType := PubOptions{}
+	if options != nil {
+		withType = *options
+	}
+	withType.Headers = make(map[string]string, len(withType.Headers)+1)
+	if options != nil {
+		for key, value := range options.Headers {
+			withType.Headers[key] = value
+		}
+	}
+	withType.Headers[HeaderContentType] = topic.Codec.ContentType()
+	return topic.Client.PublishWithOptionsCtx(ctx, topic.Name, data, &withType)
+}
+
+//hands every decoded value to the handler, fails after the OperationTimeout of the client
+func (topic *TypedTopic[T]) Subscribe(handler func(T, Metadata)) (Subscription, error) {
+	ctx, cancel := topic.Client.operationContext()
+	defer cancel()
+	return topic.SubscribeCtx(ctx, handler)
+}
+
+//Subscribe which gives up with the error of ctx when it ends before the acknowledgement
+func (topic *TypedTopic[T]) SubscribeCtx(ctx context.Context, handler func(T, Metadata)) (Subscription, error) {
+	local, err := topic.Client.subscribe(ctx, &SubDetails{Topic: topic.Name}, func(message *Message) {
+		topic.handle(message, handler)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+//decodes the message for the handler, a message of another content type is not decoded
+func (topic *TypedTopic[T]) handle(message *Message, handler func(T, Metadata)) {
+	contentType := message.Headers[HeaderContentType]
+	var value T
+	var err error
+	if len(contentType) > 0 && contentType != topic.Codec.ContentType() {
+		err = fmt.Errorf("expected content type %q", topic.Codec.ContentType())
+	} else {
+		value, err = topic.Codec.Decode(message.Data)
+	}
+	if err != nil {
+		err = &DecodeError{Topic: message.Topic, ContentType: contentType, Err: err}
+		if topic.OnDecodeError != nil {
+			topic.OnDecodeError(err)
+		} else {
+			fmt.Println(err)
+		}
+		return
+	}
+	handler(value, Metadata{Topic: message.Topic, ContentType: contentType, Headers: message.Headers})
+}
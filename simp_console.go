@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ondbyte/simp_mq/simp_broker"
+)
+
+//reads admin commands for the running broker, one per line, until in ends
+func runConsole(broker *simp_broker.SimpBroker, in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		err := consoleCommand(broker, fields, out)
+		if err != nil {
+			fmt.Fprintln(out, err)
+		}
+	}
+}
+
+//runs a single console command
+func consoleCommand(broker *simp_broker.SimpBroker, fields []string, out io.Writer) error {
+	switch fields[0] {
+	case "namespaces":
+		for _, info := range broker.Namespaces() {
+			name := info.Name
+			if len(name) == 0 {
+				name = "(default)"
+			}
+			fmt.Fprintf(out, "%s clients: [%s] topics: [%s]\n", name, strings.Join(info.Clients, " "), strings.Join(info.Topics, " "))
+		}
+		return nil
+	case "addnamespace":
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("usage: addnamespace <name> [maxconnections]")
+		}
+		ns := &simp_broker.Namespace{Name: fields[1]}
+		if len(fields) == 3 {
+			maxConnections, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid maxconnections %s", fields[2])
+			}
+			ns.MaxConnections = uint(maxConnections)
+		}
+		err := broker.AddNamespace(ns)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "namespace %s added\n", ns.Name)
+		return nil
+	case "removenamespace":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: removenamespace <name>")
+		}
+		err := broker.RemoveNamespace(fields[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "namespace %s removed, its clients were disconnected\n", fields[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s, use namespaces, addnamespace <name> [maxconnections] or removenamespace <name>", fields[0])
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
@@ -14,6 +15,15 @@ import (
 func main() {
 	var broker *simp_broker.SimpBroker
 	id, port, token, bufferSize, authWait := "demo_simp_broker", uint(8081), "password", uint(2048), time.Duration(time.Second*10)
+	priorityLevels, starvationLimit, partitions := uint(10), uint(32), uint(16)
+	tlsCert, tlsKey, tlsCA, tlsVerifyClients := "", "", "", false
+	aclFile, dataDir := "", ""
+	authMode, usersFile, hmacSecret, jwksFile := "token", "", "", ""
+	scram, noPlain := false, false
+	clientIDConflict := "takeover"
+	autoNamespaces := false
+	auditLog, auditMaxSize, auditBackups, auditTopic, auditAdminNamespace := "", uint(100), 10, "", ""
+	messageRate, byteRate, maxSubscriptions, maxConnections, onLimit := float64(0), float64(0), uint(0), uint(0), "throttle"
 	app := &cli.App{
 		Name: "simp_mq",
 		After: func(ctx *cli.Context) error {
@@ -23,6 +33,22 @@ func main() {
 			return nil
 		},
 		Commands: []*cli.Command{
+			{
+				Name:      "hashpassword",
+				Usage:     "print the bcrypt hash of a password for a users file",
+				ArgsUsage: "<password>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						return errors.New("pass exactly one password to hash")
+					}
+					hash, err := simp_broker.HashPassword(ctx.Args().First())
+					if err != nil {
+						return err
+					}
+					fmt.Println(hash)
+					return nil
+				},
+			},
 			{
 				Name:  "startbroker",
 				Usage: "start a SimpBroker",
@@ -62,6 +88,149 @@ func main() {
 						Destination: &authWait,
 						Aliases:     []string{"w"},
 					},
+					&cli.UintFlag{
+						Name:        "prioritylevels",
+						Value:       priorityLevels,
+						Usage:       "number of priority levels messages can be published with",
+						Destination: &priorityLevels,
+					},
+					&cli.UintFlag{
+						Name:        "starvationlimit",
+						Value:       starvationLimit,
+						Usage:       "a waiting low priority message is delivered after these many higher priority messages",
+						Destination: &starvationLimit,
+					},
+					&cli.UintFlag{
+						Name:        "partitions",
+						Value:       partitions,
+						Usage:       "number of partitions per topic for shared subscriptions",
+						Destination: &partitions,
+					},
+					&cli.StringFlag{
+						Name:        "datadir",
+						Usage:       "directory pull subscriptions and committed transactions are kept in across restarts, kept in memory only when empty",
+						Destination: &dataDir,
+					},
+					&cli.StringFlag{
+						Name:        "tlscert",
+						Usage:       "certificate file, SimpBroker accepts only tls connections when set",
+						Destination: &tlsCert,
+					},
+					&cli.StringFlag{
+						Name:        "tlskey",
+						Usage:       "private key file of the tls certificate",
+						Destination: &tlsKey,
+					},
+					&cli.StringFlag{
+						Name:        "tlsca",
+						Usage:       "CA certificates file client certificates are verified against",
+						Destination: &tlsCA,
+					},
+					&cli.BoolFlag{
+						Name:        "tlsverifyclients",
+						Usage:       "require a client certificate signed by the tlsca (mutual tls), a verified certificate issued to the client id (common name or dns name) authenticates the client without the token, with --auth users it gets the roles and namespace of its user",
+						Destination: &tlsVerifyClients,
+					},
+					&cli.StringFlag{
+						Name:        "auth",
+						Value:       authMode,
+						Usage:       "how clients are authenticated, token: the shared token, users: bcrypt hashed passwords of the users file, hmac: tokens signed with the hmacsecret, jwt: JWTs verified against the jwks file",
+						Destination: &authMode,
+					},
+					&cli.StringFlag{
+						Name:        "users",
+						Usage:       "users file with the client ids, password hashes and roles for --auth users",
+						Destination: &usersFile,
+					},
+					&cli.StringFlag{
+						Name:        "hmacsecret",
+						Usage:       "secret tokens are signed with for --auth hmac",
+						Destination: &hmacSecret,
+					},
+					&cli.StringFlag{
+						Name:        "jwks",
+						Usage:       "json web key set file JWTs are verified against for --auth jwt",
+						Destination: &jwksFile,
+					},
+					&cli.BoolFlag{
+						Name:        "scram",
+						Usage:       "offer SCRAM-SHA-256 so clients prove they know the token without sending it, for --auth token",
+						Destination: &scram,
+					},
+					&cli.BoolFlag{
+						Name:        "noplain",
+						Usage:       "refuse clients sending their token as is, use with --scram",
+						Destination: &noPlain,
+					},
+					&cli.StringFlag{
+						Name:        "acl",
+						Usage:       "json file with the rules allowing or denying clients to publish and subscribe to topics",
+						Destination: &aclFile,
+					},
+					&cli.StringFlag{
+						Name:        "clientidconflict",
+						Value:       clientIDConflict,
+						Usage:       "when a client connects with the id of a connected client, takeover: drop the old connection and move its session to the new one, reject: refuse the new connection",
+						Destination: &clientIDConflict,
+					},
+					&cli.BoolFlag{
+						Name:        "autonamespaces",
+						Usage:       "create the namespace of the users file entry or token claims a client authenticates with, otherwise only the default namespace exists",
+						Destination: &autoNamespaces,
+					},
+					&cli.Float64Flag{
+						Name:        "messagerate",
+						Usage:       "messages per second each client may publish, unlimited when 0",
+						Destination: &messageRate,
+					},
+					&cli.Float64Flag{
+						Name:        "byterate",
+						Usage:       "payload bytes per second each client may publish, unlimited when 0",
+						Destination: &byteRate,
+					},
+					&cli.UintFlag{
+						Name:        "maxsubscriptions",
+						Usage:       "topics each client may subscribe to at once, unlimited when 0",
+						Destination: &maxSubscriptions,
+					},
+					&cli.UintFlag{
+						Name:        "maxconnections",
+						Usage:       "clients connected at once, unlimited when 0",
+						Destination: &maxConnections,
+					},
+					&cli.StringFlag{
+						Name:        "onlimit",
+						Value:       onLimit,
+						Usage:       "what happens to a publish over the rate, throttle: its ack is delayed, reject: it fails with an error",
+						Destination: &onLimit,
+					},
+					&cli.StringFlag{
+						Name:        "auditlog",
+						Usage:       "file authentications, acl denials and session takeovers are appended to as json lines",
+						Destination: &auditLog,
+					},
+					&cli.UintFlag{
+						Name:        "auditmaxsize",
+						Value:       auditMaxSize,
+						Usage:       "megabytes after which the audit log is rotated",
+						Destination: &auditMaxSize,
+					},
+					&cli.IntFlag{
+						Name:        "auditbackups",
+						Value:       auditBackups,
+						Usage:       "rotated audit log files kept",
+						Destination: &auditBackups,
+					},
+					&cli.StringFlag{
+						Name:        "audittopic",
+						Usage:       "system topic audit events are published on as well, each namespace gets its own events on it",
+						Destination: &auditTopic,
+					},
+					&cli.StringFlag{
+						Name:        "auditadminnamespace",
+						Usage:       "namespace the audit events of every namespace are published to on the audittopic, failed authentications included",
+						Destination: &auditAdminNamespace,
+					},
 				},
 				After: func(ctx *cli.Context) error {
 					if broker == nil {
@@ -70,19 +239,136 @@ func main() {
 					return nil
 				},
 				Action: func(ctx *cli.Context) error {
-					broker = &simp_broker.SimpBroker{
-						Id:   id,
-						Port: fmt.Sprint(port),
-						Authenticator: func(deets *simp_broker.AuthDetails) error {
+					var tlsConfig *tls.Config
+					if len(tlsCert) > 0 {
+						var err error
+						tlsConfig, err = simp_broker.LoadTLSConfig(tlsCert, tlsKey, tlsCA, tlsVerifyClients)
+						if err != nil {
+							return err
+						}
+					}
+					var authenticator simp_broker.Authenticator
+					switch authMode {
+					case "token":
+						authenticator = func(deets *simp_broker.AuthDetails) error {
 							if deets.Token == token {
 								return nil
 							}
 							return errors.New("failed to authenticate")
-						},
+						}
+					case "users":
+						var err error
+						authenticator, err = simp_broker.UsersFileAuthenticator(usersFile)
+						if err != nil {
+							return err
+						}
+					case "hmac":
+						if len(hmacSecret) == 0 {
+							return errors.New("--hmacsecret is required for --auth hmac")
+						}
+						authenticator = simp_broker.HMACAuthenticator([]byte(hmacSecret))
+					case "jwt":
+						keySet, err := simp_broker.LoadJWKS(jwksFile)
+						if err != nil {
+							return err
+						}
+						authenticator = simp_broker.JWTAuthenticator(keySet)
+					default:
+						return fmt.Errorf("unknown --auth %s, use token, users, hmac or jwt", authMode)
+					}
+					if tlsVerifyClients {
+						//a client with a certificate issued to its id needs no token, with a users file
+						//it gets the roles and namespace of its user
+						var identities simp_broker.CertIdentities
+						if authMode == "users" {
+							var err error
+							identities, err = simp_broker.UsersFileIdentities(usersFile)
+							if err != nil {
+								return err
+							}
+						}
+						authenticator = simp_broker.CertAuthenticator(identities, authenticator)
+					}
+					var scramCredentials simp_broker.ScramCredentialStore
+					if scram {
+						if authMode != "token" {
+							return errors.New("--scram is only supported with --auth token")
+						}
+						credential, err := simp_broker.NewScramCredential(token, 0)
+						if err != nil {
+							return err
+						}
+						scramCredentials = func(clientID string) (*simp_broker.ScramCredential, error) {
+							return credential, nil
+						}
+					}
+					var conflictPolicy simp_broker.ConflictPolicy
+					switch clientIDConflict {
+					case "takeover":
+						conflictPolicy = simp_broker.TakeOverSession
+					case "reject":
+						conflictPolicy = simp_broker.RejectNewcomer
+					default:
+						return fmt.Errorf("unknown --clientidconflict %s, use takeover or reject", clientIDConflict)
+					}
+					limits := &simp_broker.Limits{
+						MessagesPerSecond: messageRate,
+						BytesPerSecond:    byteRate,
+						MaxSubscriptions:  maxSubscriptions,
+					}
+					switch onLimit {
+					case "throttle":
+						limits.OnLimit = simp_broker.ThrottleOnLimit
+					case "reject":
+						limits.OnLimit = simp_broker.RejectOnLimit
+					default:
+						return fmt.Errorf("unknown --onlimit %s, use throttle or reject", onLimit)
+					}
+					var authorizer simp_broker.Authorizer
+					if len(aclFile) > 0 {
+						acl, err := simp_broker.LoadACL(aclFile)
+						if err != nil {
+							return err
+						}
+						authorizer = acl.Authorize
+					}
+					broker = &simp_broker.SimpBroker{
+						Id:                        id,
+						Port:                      fmt.Sprint(port),
+						Authenticator:             authenticator,
+						ScramCredentials:          scramCredentials,
+						DisablePlainAuth:          noPlain,
+						Authorizer:                authorizer,
+						ClientIDConflict:          conflictPolicy,
+						AutoCreateNamespaces:      autoNamespaces,
+						Limits:                    limits,
+						MaxConnections:            maxConnections,
+						TLSConfig:                 tlsConfig,
 						MaxMessageBuffer:          bufferSize,
 						DropNoAuthConnectionAfter: time.Duration(1000000 * authWait),
+						PriorityLevels:            priorityLevels,
+						StarvationLimit:           starvationLimit,
+						PartitionsPerTopic:        partitions,
+						DataDir:                   dataDir,
 					}
 
+					sinks := make([]simp_broker.AuditSink, 0, 2)
+					if len(auditLog) > 0 {
+						log, err := simp_broker.NewJSONLinesAuditLog(auditLog, int64(auditMaxSize)*1024*1024, auditBackups)
+						if err != nil {
+							return err
+						}
+						sinks = append(sinks, log.Audit)
+					}
+					if len(auditTopic) > 0 {
+						sinks = append(sinks, broker.SystemTopicAuditSink(auditTopic))
+						if len(auditAdminNamespace) > 0 {
+							sinks = append(sinks, broker.AdminAuditSink(auditAdminNamespace, auditTopic))
+						}
+					}
+					if len(sinks) > 0 {
+						broker.AuditSink = simp_broker.MultiAuditSink(sinks...)
+					}
 					err := broker.Serve()
 					return err
 				},
@@ -94,6 +380,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	//namespaces are managed by typing commands while the broker runs
+	go runConsole(broker, os.Stdin, os.Stdout)
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	<-ch
@@ -1,8 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -67,6 +89,7 @@ func startSubscriptionClient(t *testing.T) error {
 		Id:             "sub_client",
 		SimpBrokerHost: "localhost:8080",
 		Token:          "password",
+		AuthMechanism:  simp_client.MechanismPlain,
 	}
 
 	err := client.ConnectToServer()
@@ -110,6 +133,7 @@ func startPublishClient(t *testing.T) error {
 		Id:             "pub_client",
 		SimpBrokerHost: "localhost:8080",
 		Token:          "password",
+		AuthMechanism:  simp_client.MechanismPlain,
 	}
 
 	err := client.ConnectToServer()
@@ -133,6 +157,3549 @@ func startPublishClient(t *testing.T) error {
 	return nil
 }
 
+func TestHigherPrioritiesGoFirstWithoutStarvingLowerOnes(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "priority_broker",
+		Port: "8106",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		MaxMessageBuffer: 16 << 20,
+		StarvationLimit:  2,
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//the subscriber reaches the broker through a relay which stops reading while the messages are published,
+	//the broker is stuck writing the first big one so the rest queue up behind it in its dispatcher
+	listener, err := net.Listen("tcp", "localhost:8121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	hold := make(chan bool)
+	go func() {
+		downstream, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer downstream.Close()
+		upstream, err := net.Dial("tcp", "localhost:8106")
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		upstream.(*net.TCPConn).SetReadBuffer(64 << 10)
+		go io.Copy(upstream, downstream)
+		decoder := json.NewDecoder(upstream)
+		encoder := json.NewEncoder(downstream)
+		held := false
+		for {
+			data := &simp_client.SimpData{}
+			if err := decoder.Decode(data); err != nil {
+				return
+			}
+			//the big message only blocks the broker, the subscriber could not read it anyway
+			if len(data.Payload) > 1<<20 {
+				continue
+			}
+			if err := encoder.Encode(data); err != nil {
+				return
+			}
+			//holds everything after the subscription was acknowledged
+			if !held && data.Type == 1 {
+				held = true
+				<-hold
+			}
+		}
+	}()
+
+	subscriber := &simp_client.SimpClient{Id: "triage_subscriber", SimpBrokerHost: "localhost:8121"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	recd := make(chan string, 10)
+	err = subscriber.Subscribe("triage", func(bytes []byte) {
+		recd <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &simp_client.SimpClient{Id: "triage_publisher", SimpBrokerHost: "localhost:8106"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	publish := func(message []byte, priority uint) {
+		err := publisher.PublishWithOptions("triage", message, &simp_client.PubOptions{Priority: priority})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a client could not read the acknowledgement of the big message, so it goes over a bare connection
+	gate, err := net.Dial("tcp", "localhost:8106")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gate.Close()
+	frame := func(kind simp_client.MessagType, payload interface{}) {
+		bytes, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//4 authenticates and 2 publishes
+		err = json.NewEncoder(gate).Encode(&simp_client.SimpData{Type: kind, ID: "gate", Payload: bytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	acks := json.NewDecoder(gate)
+	frame(4, &simp_client.AuthDetails{ClientID: "triage_gate"})
+	frame(2, &simp_client.PubDetails{Topic: "triage", Data: bytes.Repeat([]byte("g"), 6<<20)})
+	//the broker acknowledges once the message is queued for the subscriber, 3 is the pub ack and
+	//whatever comes before it is about authenticating
+	for ack := (&simp_client.SimpData{}); ack.Type != 3; {
+		err = acks.Decode(ack)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	for _, message := range []string{"low1", "low2", "low3"} {
+		publish([]byte(message), 0)
+	}
+	for _, message := range []string{"high1", "high2", "high3", "high4", "high5", "high6"} {
+		publish([]byte(message), 9)
+	}
+	close(hold)
+
+	//every second high message lets a low one through with a starvation limit of 2
+	expected := []string{"high1", "high2", "low1", "high3", "high4", "low2", "high5", "high6", "low3"}
+	for i, want := range expected {
+		select {
+		case got := <-recd:
+			if got != want {
+				t.Fatalf("message %d: expected %s, got %s", i, want, got)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only %d of %d messages were delivered", i, len(expected))
+		}
+	}
+}
+
+func TestOversizedFrameIsRefusedBeforeItIsBuffered(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "frame_guard_broker",
+		Port: "8107",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	conn, err := net.Dial("tcp", "localhost:8107")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//one endless value, the broker must give up long before the authentication deadline
+	go func() {
+		conn.Write([]byte(`{"payload":"`))
+		chunk := bytes.Repeat([]byte("a"), 4096)
+		for i := 0; i < 256; i++ {
+			_, err := conn.Write(chunk)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	//the connection must be dropped
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.Copy(io.Discard, conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Error("broker kept reading a frame larger than its buffer")
+	}
+}
+
+func TestSharedSubscriptionKeepsKeyOrder(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "shared_broker",
+		Port: "8082",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	type delivery struct {
+		worker  string
+		message string
+	}
+	recd := make(chan delivery, 100)
+	for _, worker := range []string{"worker_a", "worker_b"} {
+		worker := worker
+		client := &simp_client.SimpClient{Id: worker, SimpBrokerHost: "localhost:8082"}
+		err := client.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		err = client.SubscribeShared("orders", "workers", func(bytes []byte) {
+			recd <- delivery{worker: worker, message: string(bytes)}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publisher := &simp_client.SimpClient{Id: "order_publisher", SimpBrokerHost: "localhost:8082"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	keys, perKey := []string{"order-1", "order-2", "order-3", "order-4"}, 5
+	for i := 0; i < perKey; i++ {
+		for _, key := range keys {
+			err := publisher.PublishWithOptions("orders", []byte(fmt.Sprintf("%s:%d", key, i)), &simp_client.PubOptions{Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	workerOfKey := make(map[string]string)
+	nextOfKey := make(map[string]int)
+	for i := 0; i < len(keys)*perKey; i++ {
+		select {
+		case d := <-recd:
+			var key string
+			var seq int
+			fmt.Sscanf(strings.Replace(d.message, ":", " ", 1), "%s %d", &key, &seq)
+			if worker, ok := workerOfKey[key]; ok && worker != d.worker {
+				t.Errorf("messages of %s were delivered to %s and %s", key, worker, d.worker)
+			}
+			workerOfKey[key] = d.worker
+			if seq != nextOfKey[key] {
+				t.Errorf("expected message %d of %s but recieved %d", nextOfKey[key], key, seq)
+			}
+			nextOfKey[key] = seq + 1
+		case <-time.After(time.Second * 5):
+			t.Fatalf("recieved only %d of %d messages", i, len(keys)*perKey)
+		}
+	}
+}
+
+func TestTransactionIsVisibleOnlyAfterCommit(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "tx_broker",
+		Port: "8108",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	subscriber := &simp_client.SimpClient{Id: "ledger", SimpBrokerHost: "localhost:8108"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	recd := make(chan string, 10)
+	for _, topic := range []string{"orders", "invoices"} {
+		topic := topic
+		err = subscriber.Subscribe(topic, func(bytes []byte) {
+			recd <- topic + ":" + string(bytes)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publisher := &simp_client.SimpClient{Id: "checkout", SimpBrokerHost: "localhost:8108"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	tx := publisher.BeginTx()
+	for topic, payload := range map[string]string{"orders": "created", "invoices": "issued"} {
+		err = tx.Publish(topic, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case message := <-recd:
+		t.Fatalf("%s was visible before the commit", message)
+	case <-time.After(time.Millisecond * 200):
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, 2)
+	for len(got) < 2 {
+		select {
+		case message := <-recd:
+			got = append(got, message)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only %v arrived after the commit", got)
+		}
+	}
+	if !(got[0] == "orders:created" || got[1] == "orders:created") || !(got[0] == "invoices:issued" || got[1] == "invoices:issued") {
+		t.Errorf("expected both messages of the transaction, got %v", got)
+	}
+
+	aborted := publisher.BeginTx()
+	err = aborted.Publish("orders", []byte("cancelled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = aborted.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = publisher.Publish("orders", []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-recd:
+		if message != "orders:after" {
+			t.Errorf("aborted transaction was delivered, got %s", message)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("publish after the abort was not delivered")
+	}
+}
+
+func TestBrokerStopsAtTheGrantedCredits(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "credit_broker",
+		Port: "8110",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//counts the messages the broker sends to the subscriber on their way through a relay
+	listener, err := net.Listen("tcp", "localhost:8122")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var arrived int32
+	go func() {
+		downstream, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer downstream.Close()
+		upstream, err := net.Dial("tcp", "localhost:8110")
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, downstream)
+		decoder := json.NewDecoder(upstream)
+		encoder := json.NewEncoder(downstream)
+		for {
+			data := &simp_client.SimpData{}
+			if err := decoder.Decode(data); err != nil {
+				return
+			}
+			//2 is a published message
+			if data.Type == 2 {
+				atomic.AddInt32(&arrived, 1)
+			}
+			if err := encoder.Encode(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	subscriber := &simp_client.SimpClient{Id: "slow_subscriber", SimpBrokerHost: "localhost:8122", Prefetch: 4}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	gate := make(chan bool)
+	err = subscriber.Subscribe("feed", func(bytes []byte) {
+		<-gate
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &simp_client.SimpClient{Id: "feeder", SimpBrokerHost: "localhost:8110"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	for i := 0; i < 20; i++ {
+		err = publisher.Publish("feed", []byte("held"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 300)
+	if n := atomic.LoadInt32(&arrived); n > 4 {
+		t.Errorf("broker sent %d messages beyond the prefetch of 4 while the listener was blocked", n-4)
+	}
+
+	close(gate)
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&arrived) < 20 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := atomic.LoadInt32(&arrived); n != 20 {
+		t.Errorf("expected the broker to resume once credits were granted, %d of 20 messages arrived", n)
+	}
+}
+
+func TestPullSubscriptionResumesAfterLastAck(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "pull_broker",
+		Port: "8083",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	connectWorker := func() *simp_client.SimpClient {
+		worker := &simp_client.SimpClient{Id: "batch_worker", SimpBrokerHost: "localhost:8083"}
+		err := worker.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = worker.SubscribePull("jobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return worker
+	}
+	connectWorker().Close()
+
+	publisher := &simp_client.SimpClient{Id: "job_publisher", SimpBrokerHost: "localhost:8083"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	for i := 0; i < 5; i++ {
+		err := publisher.Publish("jobs", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	worker := connectWorker()
+	messages, err := worker.Fetch(context.Background(), "jobs", 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || string(messages[0].Data) != "0" || string(messages[2].Data) != "2" {
+		t.Fatalf("expected jobs 0 to 2, recieved %d messages", len(messages))
+	}
+	//only the first two are done, the third must come back in the next session
+	err = messages[1].Ack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.Close()
+
+	worker = connectWorker()
+	defer worker.Close()
+	messages, err = worker.Fetch(context.Background(), "jobs", 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recd := make([]string, 0)
+	for _, message := range messages {
+		recd = append(recd, string(message.Data))
+	}
+	if strings.Join(recd, ",") != "2,3,4" {
+		t.Errorf("expected jobs 2,3,4 after reconnecting but recieved %v", recd)
+	}
+}
+
+func TestFetchesOfAConnectionAreCapped(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "fetch_cap_broker",
+		Port: "8132",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		MaxFetchesPerConnection: 2,
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	worker := &simp_client.SimpClient{Id: "greedy_worker", SimpBrokerHost: "localhost:8132"}
+	err = worker.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	err = worker.SubscribePull("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nothing arrives, two fetches wait and the third is refused right away
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := worker.Fetch(context.Background(), "jobs", 1, time.Second)
+			results <- err
+		}()
+	}
+	select {
+	case err := <-results:
+		if err == nil || !strings.Contains(err.Error(), "at most 2 fetches") {
+			t.Errorf("expected the third fetch to be refused, got %v", err)
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("fetch over the cap was not refused")
+	}
+	for i := 0; i < 2; i++ {
+		err = <-results
+		if err != nil {
+			t.Errorf("fetch within the cap failed: %v", err)
+		}
+	}
+
+	//a fetch for no messages is answered at once, without waiting for the broker's MaxFetchWait
+	conn, err := net.Dial("tcp", "localhost:8132")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	//4 authenticates and 13 fetches
+	for _, request := range []struct {
+		kind    simp_client.MessagType
+		details interface{}
+	}{
+		{4, &simp_client.AuthDetails{ClientID: "raw_worker"}},
+		{13, &simp_client.FetchDetails{Topic: "jobs", Max: 0, MaxWait: 5000}},
+	} {
+		payload, err := json.Marshal(request.details)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = encoder.Encode(&simp_client.SimpData{Type: request.kind, ID: fmt.Sprint("raw_", request.kind), Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	//15 ends a fetch
+	for frame := (&simp_client.SimpData{}); frame.Type != 15; {
+		err = decoder.Decode(frame)
+		if err != nil {
+			t.Fatalf("empty fetch was not answered at once: %v", err)
+		}
+	}
+}
+
+func TestCommittedTransactionSurvivesARestart(t *testing.T) {
+	dataDir := t.TempDir()
+	serve := func() *simp_broker.SimpBroker {
+		broker := &simp_broker.SimpBroker{
+			Id:   "durable_broker",
+			Port: "8109",
+			Authenticator: func(deets *simp_broker.AuthDetails) error {
+				return nil
+			},
+			DataDir: dataDir,
+		}
+		var err error
+		for i := 0; i < 20; i++ {
+			err = broker.Serve()
+			if err == nil {
+				return broker
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		t.Fatal(err)
+		return nil
+	}
+	connectWorker := func() *simp_client.SimpClient {
+		worker := &simp_client.SimpClient{Id: "durable_worker", SimpBrokerHost: "localhost:8109"}
+		err := worker.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, topic := range []string{"jobs", "reports"} {
+			err = worker.SubscribePull(topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return worker
+	}
+
+	broker := serve()
+	connectWorker().Close()
+	publisher := &simp_client.SimpClient{Id: "durable_publisher", SimpBrokerHost: "localhost:8109"}
+	err := publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := publisher.BeginTx()
+	committed.Publish("jobs", []byte("job"))
+	committed.Publish("reports", []byte("report"))
+	err = committed.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//staged only, the broker goes down before the commit
+	staged := publisher.BeginTx()
+	staged.Publish("jobs", []byte("staged"))
+	publisher.Close()
+	broker.Close()
+
+	//a transaction torn by a crash while it was written
+	journal, err := os.OpenFile(filepath.Join(dataDir, "journal"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = journal.Write([]byte(`{"op":"pub","messages":[{"topic":"jobs","id":"torn","payload":"eyJ0b3BpYyI6ImpvYnMi`))
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker = serve()
+	defer broker.Close()
+	worker := connectWorker()
+	defer worker.Close()
+	for topic, expected := range map[string]string{"jobs": "job", "reports": "report"} {
+		messages, err := worker.Fetch(context.Background(), topic, 10, time.Millisecond*200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recd := make([]string, 0)
+		for _, message := range messages {
+			recd = append(recd, string(message.Data))
+		}
+		if strings.Join(recd, ",") != expected {
+			t.Errorf("expected only %s on %s after the restart, got %v", expected, topic, recd)
+		}
+	}
+}
+
+func TestTransactionIsNotCommittedAfterItsMessagesWereLost(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "tx_guard_broker",
+		Port: "8123",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		MaxStagedMessages: 2,
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	relayed, _ := startSwallowingRelay(t, "localhost:8124", "localhost:8123")
+
+	subscriber := &simp_client.SimpClient{Id: "tx_guard_ledger", SimpBrokerHost: "localhost:8123"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	recd := make(chan string, 10)
+	err = subscriber.Subscribe("orders", func(bytes []byte) {
+		recd <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &simp_client.SimpClient{Id: "tx_guard_checkout", SimpBrokerHost: "localhost:8124", AutoReconnect: true}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	first := <-relayed
+
+	//the connection the messages were staged on is lost before the commit
+	lost := publisher.BeginTx()
+	err = lost.Publish("orders", []byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	select {
+	case <-relayed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("publisher did not reconnect")
+	}
+	for publisher.State() != simp_client.StateConnected {
+		time.Sleep(time.Millisecond * 10)
+	}
+	err = lost.Commit()
+	if !errors.Is(err, simp_client.ErrDisconnected) {
+		t.Errorf("expected the commit after a reconnect to fail with ErrDisconnected, got %v", err)
+	}
+
+	//more staged messages than the broker allows fail the whole transaction
+	big := publisher.BeginTx()
+	for _, payload := range []string{"one", "two", "three"} {
+		err = big.Publish("orders", []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = big.Commit()
+	if err == nil || !strings.Contains(err.Error(), "more than 2 messages") {
+		t.Errorf("expected the transaction over the staging limit to fail, got %v", err)
+	}
+
+	//the refused transaction released what it staged
+	small := publisher.BeginTx()
+	err = small.Publish("orders", []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = small.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-recd:
+		if message != "small" {
+			t.Errorf("only the last transaction should be delivered, got %s", message)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("committed transaction was not delivered")
+	}
+}
+
+func TestJournalIsCompactedAndRefusedWhenCorrupt(t *testing.T) {
+	dataDir := t.TempDir()
+	path := filepath.Join(dataDir, "journal")
+	serve := func() (*simp_broker.SimpBroker, error) {
+		broker := &simp_broker.SimpBroker{
+			Id:   "compacting_broker",
+			Port: "8125",
+			Authenticator: func(deets *simp_broker.AuthDetails) error {
+				return nil
+			},
+			DataDir:        dataDir,
+			MaxJournalSize: 4096,
+		}
+		var err error
+		for i := 0; i < 20; i++ {
+			err = broker.Serve()
+			if err == nil || strings.Contains(err.Error(), "corrupt") {
+				return broker, err
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		return broker, err
+	}
+	broker, err := serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := &simp_client.SimpClient{Id: "compacting_worker", SimpBrokerHost: "localhost:8125"}
+	err = worker.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worker.SubscribePull("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &simp_client.SimpClient{Id: "compacting_publisher", SimpBrokerHost: "localhost:8125"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every acknowledged message is dropped from the journal once it grows past its limit
+	for i := 0; i < 100; i++ {
+		err = publisher.Publish("jobs", []byte(fmt.Sprintf("job %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := worker.Fetch(context.Background(), "jobs", 1, time.Second)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("expected job %d, got %v %v", i, messages, err)
+		}
+		err = messages[0].Ack()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 4096*2 {
+		t.Errorf("journal of %d bytes was not compacted", info.Size())
+	}
+	publisher.Close()
+	worker.Close()
+	broker.Close()
+
+	//a record in the middle of the journal does not parse
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = journal.Write([]byte("{\"op\":\"ack\",\"ns\n{\"op\":\"unpull\",\"topic\":\"jobs\",\"clientId\":\"compacting_worker\"}\n"))
+	journal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker, err = serve()
+	if err == nil {
+		broker.Close()
+		t.Fatal("expected the broker to refuse a corrupt journal")
+	}
+}
+
+func TestMutualTLSPassesCertSubjectToAuthenticator(t *testing.T) {
+	caPool, serverCert, clientCert := generateTestCertificates(t)
+	broker := &simp_broker.SimpBroker{
+		Id:   "tls_broker",
+		Port: "8084",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			if deets.CertCommonName == "secure_client" {
+				return nil
+			}
+			return fmt.Errorf("unknown certificate subject %q", deets.CertSubject)
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    caPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	client := &simp_client.SimpClient{
+		Id:             "secure_client",
+		SimpBrokerHost: "localhost:8084",
+		TLSConfig:      &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}},
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	recd := make(chan []byte, 1)
+	err = client.Subscribe("secure_topic", func(bytes []byte) {
+		recd <- bytes
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish("secure_topic", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-recd:
+		if string(message) != "secret" {
+			t.Errorf("recieved %q instead of the published message", message)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("message was not recieved over tls")
+	}
+
+	anonymous := &simp_client.SimpClient{
+		Id:             "anonymous_client",
+		SimpBrokerHost: "localhost:8084",
+		TLSConfig:      &tls.Config{RootCAs: caPool},
+	}
+	err = anonymous.ConnectToServer()
+	if err == nil {
+		anonymous.Close()
+		t.Error("client without a certificate must not connect")
+	}
+}
+
+func TestClientCertificateOnlyVouchesForItsOwnID(t *testing.T) {
+	caPool, serverCert, clientCert := generateTestCertificates(t)
+	broker := &simp_broker.SimpBroker{
+		Id:   "cert_id_broker",
+		Port: "8105",
+		Authenticator: simp_broker.CertAuthenticator(func(clientID string) ([]string, string, error) {
+			return []string{"billing"}, "", nil
+		}, func(deets *simp_broker.AuthDetails) error {
+			return errors.New("failed to authenticate")
+		}),
+		//only the roles looked up for the certificate let the client publish
+		Authorizer: func(deets *simp_broker.AuthDetails, action simp_broker.Action, topic string) error {
+			if len(deets.Roles) != 1 || deets.Roles[0] != "billing" {
+				return fmt.Errorf("%s has no billing role", deets.ClientID)
+			}
+			return nil
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    caPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	owner := &simp_client.SimpClient{
+		Id:             "secure_client",
+		SimpBrokerHost: "localhost:8105",
+		TLSConfig:      &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}},
+	}
+	err = owner.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	err = owner.Publish("invoices", []byte("paid"))
+	if err != nil {
+		t.Errorf("client authenticated by its certificate must get its roles: %v", err)
+	}
+
+	//a valid certificate, issued to secure_client
+	impostor := &simp_client.SimpClient{
+		Id:             "billing_client",
+		SimpBrokerHost: "localhost:8105",
+		TLSConfig:      &tls.Config{RootCAs: caPool, Certificates: []tls.Certificate{clientCert}},
+	}
+	err = impostor.ConnectToServer()
+	if err == nil {
+		impostor.Close()
+		t.Error("a certificate issued to another client id must not authenticate")
+	}
+}
+
+func TestACLDenialIsReportedToClient(t *testing.T) {
+	acl := &simp_broker.ACL{Rules: []simp_broker.ACLRule{
+		{Effect: "allow", Actions: []simp_broker.Action{simp_broker.ActionPublish}, ClientIDs: []string{"acl_client"}, Topics: []string{"orders.*"}},
+		{Effect: "deny", Topics: []string{"*"}},
+	}}
+	broker := &simp_broker.SimpBroker{
+		Id:   "acl_broker",
+		Port: "8085",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		Authorizer: acl.Authorize,
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	client := &simp_client.SimpClient{Id: "acl_client", SimpBrokerHost: "localhost:8085"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Publish("orders.created", []byte("allowed"))
+	if err != nil {
+		t.Errorf("publish to an allowed topic failed: %v", err)
+	}
+	err = client.Publish("payments.created", []byte("denied"))
+	if err == nil {
+		t.Error("publish to a denied topic must fail")
+	}
+	err = client.Subscribe("orders.created", func(bytes []byte) {})
+	if err == nil {
+		t.Error("subscribe without an allow rule must fail")
+	}
+}
+
+func TestHMACTokenRolesFeedACL(t *testing.T) {
+	secret := []byte("hmac secret")
+	acl := &simp_broker.ACL{Rules: []simp_broker.ACLRule{
+		{Effect: "allow", Roles: []string{"billing"}, Topics: []string{"invoices"}},
+	}}
+	broker := &simp_broker.SimpBroker{
+		Id:            "hmac_broker",
+		Port:          "8086",
+		Authenticator: simp_broker.HMACAuthenticator(secret),
+		Authorizer:    acl.Authorize,
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	token, err := simp_broker.SignHMACToken(secret, &simp_broker.TokenClaims{
+		Subject:   "billing_client",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Roles:     []string{"billing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &simp_client.SimpClient{Id: "billing_client", SimpBrokerHost: "localhost:8086", Token: token, AuthMechanism: simp_client.MechanismPlain}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Publish("invoices", []byte("issued"))
+	if err != nil {
+		t.Errorf("role from the token must allow publishing: %v", err)
+	}
+
+	impostor := &simp_client.SimpClient{Id: "other_client", SimpBrokerHost: "localhost:8086", Token: token, AuthMechanism: simp_client.MechanismPlain}
+	err = impostor.ConnectToServer()
+	if err == nil {
+		impostor.Close()
+		t.Error("token issued to another client must be rejected")
+	}
+}
+
+func TestUsersFileAuthenticatorChecksPasswordHashes(t *testing.T) {
+	hash, err := simp_broker.HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	bytes, err := json.Marshal(map[string]interface{}{"users": []*simp_broker.User{
+		{ClientID: "alice", PasswordHash: hash, Roles: []string{"worker"}, Namespace: "team-a"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(usersFile, bytes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate, err := simp_broker.UsersFileAuthenticator(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deets := &simp_broker.AuthDetails{ClientID: "alice", Token: "s3cret"}
+	err = authenticate(deets)
+	if err != nil {
+		t.Errorf("matching password must authenticate: %v", err)
+	}
+	if strings.Join(deets.Roles, ",") != "worker" || deets.Namespace != "team-a" {
+		t.Errorf("expected the roles and namespace of the user, got %v in %q", deets.Roles, deets.Namespace)
+	}
+	for _, deets := range []*simp_broker.AuthDetails{
+		{ClientID: "alice", Token: "wrong"},
+		{ClientID: "alice", Token: hash},
+		{ClientID: "mallory", Token: "s3cret"},
+	} {
+		if authenticate(deets) == nil {
+			t.Errorf("%s with token %q must not authenticate", deets.ClientID, deets.Token)
+		}
+	}
+	//an unknown client costs a hash comparison like a wrong password, its refusal comes no faster
+	took := func(deets *simp_broker.AuthDetails) time.Duration {
+		start := time.Now()
+		authenticate(deets)
+		return time.Since(start)
+	}
+	wrong, unknown := took(&simp_broker.AuthDetails{ClientID: "alice", Token: "wrong"}), took(&simp_broker.AuthDetails{ClientID: "mallory", Token: "wrong"})
+	if unknown < wrong/4 {
+		t.Errorf("unknown client refused in %v, a wrong password in %v", unknown, wrong)
+	}
+
+	broken := filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(broken, []byte("{users"), 0600)
+	_, err = simp_broker.UsersFileAuthenticator(broken)
+	if err == nil {
+		t.Error("invalid users file must be refused")
+	}
+}
+
+func TestJWTAuthenticatorVerifiesSignaturesAndClaims(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("jwt hmac secret of 32 bytes long")
+	keySet := &simp_broker.JWKSet{Keys: []*simp_broker.JWK{
+		{Kid: "rsa", Kty: "RSA", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kid: "ec", Kty: "EC", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{Kid: "oct", Kty: "oct", K: b64(secret)},
+		{Kid: "rsa-only", Kty: "oct", Alg: "RS256", K: b64(secret)},
+	}}
+	keysFile := filepath.Join(t.TempDir(), "jwks.json")
+	bytes, err := json.Marshal(keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keysFile, bytes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := simp_broker.LoadJWKS(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticate := simp_broker.JWTAuthenticator(loaded)
+
+	hs256 := func(key []byte) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	sign := func(alg string, kid string, claims *simp_broker.TokenClaims, signer func([]byte) []byte) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		return signed + "." + b64(signer([]byte(signed)))
+	}
+	valid := &simp_broker.TokenClaims{Subject: "jwt_client", ExpiresAt: time.Now().Add(time.Minute).Unix(), Roles: []string{"reader"}}
+	expired := &simp_broker.TokenClaims{Subject: "jwt_client", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	early := &simp_broker.TokenClaims{Subject: "jwt_client", NotBefore: time.Now().Add(time.Minute).Unix()}
+	other := &simp_broker.TokenClaims{Subject: "other_client"}
+
+	for _, token := range []string{
+		sign("RS256", "rsa", valid, rs256),
+		sign("ES256", "ec", valid, es256),
+		sign("HS256", "oct", valid, hs256(secret)),
+	} {
+		deets := &simp_broker.AuthDetails{ClientID: "jwt_client", Token: token}
+		err := authenticate(deets)
+		if err != nil {
+			t.Errorf("valid token must authenticate: %v", err)
+		}
+		if strings.Join(deets.Roles, ",") != "reader" {
+			t.Errorf("expected the roles claim, got %v", deets.Roles)
+		}
+	}
+
+	tampered := strings.Split(sign("RS256", "rsa", valid, rs256), ".")
+	adminClaims, _ := json.Marshal(&simp_broker.TokenClaims{Subject: "jwt_client", Roles: []string{"admin"}})
+	tampered[1] = b64(adminClaims)
+	rejected := map[string]string{
+		"unknown kid":           sign("RS256", "missing", valid, rs256),
+		"expired":               sign("ES256", "ec", expired, es256),
+		"not valid yet":         sign("ES256", "ec", early, es256),
+		"issued to another id":  sign("RS256", "rsa", other, rs256),
+		"tampered claims":       strings.Join(tampered, "."),
+		"wrong hmac secret":     sign("HS256", "oct", valid, hs256([]byte("guessed"))),
+		"HS256 with public key": sign("HS256", "rsa", valid, hs256(rsaKey.N.Bytes())),
+		"RS256 with oct key":    sign("RS256", "oct", valid, rs256),
+		"alg the key forbids":   sign("HS256", "rsa-only", valid, hs256(secret)),
+		"none":                  b64([]byte(`{"alg":"none","kid":"oct"}`)) + "." + b64([]byte(`{"sub":"jwt_client"}`)) + ".",
+		"malformed":             "not.a.jwt.at.all",
+	}
+	for name, token := range rejected {
+		err := authenticate(&simp_broker.AuthDetails{ClientID: "jwt_client", Token: token})
+		if err == nil {
+			t.Errorf("token must be rejected: %s", name)
+		}
+	}
+}
+
+func TestScramAuthenticationKeepsTokenOffTheWire(t *testing.T) {
+	credential, err := simp_broker.NewScramCredential("scram secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &simp_broker.SimpBroker{
+		Id:   "scram_broker",
+		Port: "8087",
+		ScramCredentials: func(clientID string) (*simp_broker.ScramCredential, error) {
+			if clientID != "scram_client" {
+				return nil, errors.New("unknown client")
+			}
+			return credential, nil
+		},
+		DisablePlainAuth: true,
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	client := &simp_client.SimpClient{
+		Id:             "scram_client",
+		SimpBrokerHost: "localhost:8087",
+		Token:          "scram secret",
+		AuthMechanism:  simp_client.MechanismScramSHA256,
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	//without a mechanism the client takes the one the broker offers
+	negotiated := &simp_client.SimpClient{Id: "scram_client", SimpBrokerHost: "localhost:8087", Token: "scram secret"}
+	err = negotiated.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiated.Close()
+
+	for _, rejected := range []*simp_client.SimpClient{
+		{Id: "scram_client", SimpBrokerHost: "localhost:8087", Token: "wrong secret", AuthMechanism: simp_client.MechanismScramSHA256},
+		{Id: "scram_client", SimpBrokerHost: "localhost:8087", Token: "scram secret", AuthMechanism: simp_client.MechanismPlain},
+	} {
+		err = rejected.ConnectToServer()
+		if err == nil {
+			rejected.Close()
+			t.Errorf("client with mechanism %q and token %q must be rejected", rejected.AuthMechanism, rejected.Token)
+		}
+	}
+}
+
+func TestScramDoesNotRevealWhichClientsExist(t *testing.T) {
+	credential, err := simp_broker.NewScramCredential("scram secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &simp_broker.SimpBroker{
+		Id:   "scram_probe_broker",
+		Port: "8111",
+		ScramCredentials: func(clientID string) (*simp_broker.ScramCredential, error) {
+			if clientID != "known_client" {
+				return nil, errors.New("unknown client")
+			}
+			return credential, nil
+		},
+		DisablePlainAuth: true,
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//relays one connection to the broker and records every frame the broker sends
+	ln, err := net.Listen("tcp", "localhost:8112")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	attempt := func(clientID string) []*simp_client.SimpData {
+		frames := make(chan []*simp_client.SimpData, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				frames <- nil
+				return
+			}
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", "localhost:8111")
+			if err != nil {
+				frames <- nil
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			recorded := make([]*simp_client.SimpData, 0)
+			decoder := json.NewDecoder(io.TeeReader(upstream, conn))
+			for {
+				data := &simp_client.SimpData{}
+				if decoder.Decode(data) != nil {
+					break
+				}
+				recorded = append(recorded, data)
+			}
+			frames <- recorded
+		}()
+		client := &simp_client.SimpClient{Id: clientID, SimpBrokerHost: "localhost:8112", Token: "guess"}
+		err := client.ConnectToServer()
+		if err == nil {
+			client.Close()
+			t.Fatalf("%s must not authenticate with a guessed secret", clientID)
+		}
+		return <-frames
+	}
+	challenge := func(frames []*simp_client.SimpData) *simp_client.ScramDetails {
+		if len(frames) != 3 {
+			t.Fatalf("expected a greeting, a challenge and a refusal, the broker sent %d frames", len(frames))
+		}
+		deets, err := frames[1].GetScramDetails()
+		if err != nil || len(deets.Salt) == 0 || deets.Iterations == 0 {
+			t.Fatalf("second frame is not a challenge: %v", err)
+		}
+		return deets
+	}
+
+	known := attempt("known_client")
+	unknown := attempt("unknown_client")
+	again := attempt("unknown_client")
+	for i := range known {
+		if i < len(unknown) && known[i].Type != unknown[i].Type {
+			t.Errorf("frame %d differs for an unknown client, %d instead of %d", i, unknown[i].Type, known[i].Type)
+		}
+	}
+	knownChallenge, unknownChallenge, againChallenge := challenge(known), challenge(unknown), challenge(again)
+	if knownChallenge.Iterations != unknownChallenge.Iterations || len(knownChallenge.Salt) != len(unknownChallenge.Salt) {
+		t.Error("challenge of an unknown client looks different from the one of a known client")
+	}
+	if !bytes.Equal(unknownChallenge.Salt, againChallenge.Salt) {
+		t.Error("salt of an unknown client must not change between attempts")
+	}
+	greeting, err := known[0].GetHelloDetails()
+	if err != nil || strings.Join(greeting.Mechanisms, ",") != simp_client.MechanismScramSHA256 {
+		t.Errorf("expected the broker to offer only %s first, got %v", simp_client.MechanismScramSHA256, greeting)
+	}
+}
+
+func TestTokenIsSentInPlainOnlyWhenAskedFor(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "plain_broker",
+		Port: "8126",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			if deets.Token != "password" {
+				return errors.New("wrong token")
+			}
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//a client which does not ask for the mechanisms is acknowledged right away, without a greeting
+	conn, err := net.Dial("tcp", "localhost:8126")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload, err := json.Marshal(&simp_client.AuthDetails{ClientID: "old_client", Token: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewEncoder(conn).Encode(&simp_client.SimpData{Type: 4, ID: "old_client", Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &simp_client.SimpData{}
+	err = json.NewDecoder(conn).Decode(ack)
+	if err != nil || ack.Type != 5 {
+		t.Fatalf("expected an auth ack as the first frame, got %+v, %v", ack, err)
+	}
+
+	//the broker offers no scram, the token stays with the client until it opts into plain
+	client := &simp_client.SimpClient{Id: "new_client", SimpBrokerHost: "localhost:8126", Token: "password"}
+	err = client.ConnectToServer()
+	if err == nil || !strings.Contains(err.Error(), simp_client.MechanismPlain) {
+		client.Close()
+		t.Fatalf("expected the client to refuse sending its token in plain, got %v", err)
+	}
+	client.AuthMechanism = simp_client.MechanismPlain
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestSessionTakeoverMovesSubscriptions(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "takeover_broker",
+		Port: "8088",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	rejections := make(chan *simp_broker.AuditEvent, 1)
+	broker.AuditSink = func(event *simp_broker.AuditEvent) {
+		if event.Kind == simp_broker.AuditSessionRejected {
+			rejections <- event
+		}
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	takenOver := make(chan string, 1)
+	old := &simp_client.SimpClient{Id: "roaming_client", SimpBrokerHost: "localhost:8088"}
+	old.OnSessionTakenOver = func(reason string) {
+		takenOver <- reason
+	}
+	err = old.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.Subscribe("news", func(bytes []byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := &simp_client.SimpClient{Id: "roaming_client", SimpBrokerHost: "localhost:8088"}
+	refused := make(chan string, 1)
+	replacement.OnTakeoverRefused = func(reason string) {
+		refused <- reason
+	}
+	err = replacement.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Close()
+	if !replacement.TookOverSession || len(replacement.InheritedTopics) != 1 || replacement.InheritedTopics[0] != "news" {
+		t.Errorf("new connection must inherit the news subscription, took over %v topics %v", replacement.TookOverSession, replacement.InheritedTopics)
+	}
+	select {
+	case <-takenOver:
+	case <-time.After(time.Second * 5):
+		t.Fatal("old connection was not told about the takeover")
+	}
+
+	recieved := make(chan string, 1)
+	err = replacement.Subscribe("news", func(bytes []byte) {
+		recieved <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &simp_client.SimpClient{Id: "news_publisher", SimpBrokerHost: "localhost:8088"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	err = publisher.Publish("news", []byte("extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-recieved:
+		if msg != "extra" {
+			t.Errorf("expected extra, got %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message was not delivered to the new connection")
+	}
+
+	broker.ClientIDConflict = simp_broker.RejectNewcomer
+	rejected := &simp_client.SimpClient{Id: "roaming_client", SimpBrokerHost: "localhost:8088"}
+	err = rejected.ConnectToServer()
+	if err == nil {
+		rejected.Close()
+		t.Error("a second connection with the same id must be rejected")
+	}
+	//the rejection is audited and the connected client hears about it
+	select {
+	case event := <-rejections:
+		if event.ClientID != "roaming_client" {
+			t.Errorf("rejection audited for %s", event.ClientID)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("rejected newcomer was not audited")
+	}
+	select {
+	case <-refused:
+	case <-time.After(time.Second * 5):
+		t.Error("connected client was not told about the refused takeover")
+	}
+}
+
+func TestRateLimitAndSubscriptionCap(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "limits_broker",
+		Port: "8089",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		Limits: &simp_broker.Limits{MessagesPerSecond: 20},
+		ClientLimits: map[string]*simp_broker.Limits{
+			"noisy_client": {MessagesPerSecond: 1, MaxSubscriptions: 1, OnLimit: simp_broker.RejectOnLimit},
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	noisy := &simp_client.SimpClient{Id: "noisy_client", SimpBrokerHost: "localhost:8089"}
+	err = noisy.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noisy.Close()
+	err = noisy.Publish("chatter", []byte("first"))
+	if err != nil {
+		t.Fatalf("first publish must pass: %v", err)
+	}
+	err = noisy.Publish("chatter", []byte("second"))
+	if err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Errorf("second publish within the second must be rejected, got %v", err)
+	}
+	err = noisy.Subscribe("a", func(bytes []byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = noisy.Subscribe("b", func(bytes []byte) {})
+	if err == nil {
+		t.Error("subscription over the cap must be rejected")
+	}
+
+	//the global limit throttles, 20 messages per second with a burst of 20 takes about a second for 40
+	steady := &simp_client.SimpClient{Id: "steady_client", SimpBrokerHost: "localhost:8089"}
+	err = steady.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer steady.Close()
+	start := time.Now()
+	for i := 0; i < 40; i++ {
+		err = steady.Publish("chatter", []byte("steady"))
+		if err != nil {
+			t.Fatalf("throttled publish must not fail: %v", err)
+		}
+	}
+	if took := time.Since(start); took < time.Millisecond*800 {
+		t.Errorf("publishes were not throttled, 40 took %v", took)
+	}
+	//only the publishes wait, a subscription behind them is handled right away
+	futures := make([]*simp_client.PublishFuture, 0, 20)
+	for i := 0; i < 20; i++ {
+		future, err := steady.PublishAsync("chatter", []byte("queued"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	err = steady.SubscribeCtx(ctx, "chatter", func(bytes []byte) {})
+	if err != nil {
+		t.Errorf("subscription waited for the throttled publishes: %v", err)
+	}
+	for _, future := range futures {
+		err = future.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditTrailIsWrittenAndPublished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := simp_broker.NewJSONLinesAuditLog(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	acl := &simp_broker.ACL{Rules: []simp_broker.ACLRule{
+		{Effect: "deny", Actions: []simp_broker.Action{simp_broker.ActionPublish}, Topics: []string{"secrets"}},
+	}, DefaultAllow: true}
+	broker := &simp_broker.SimpBroker{
+		Id:   "audit_broker",
+		Port: "8090",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			if deets.Token != "audit" {
+				return errors.New("failed to authenticate")
+			}
+			return nil
+		},
+		Authorizer: acl.Authorize,
+	}
+	//the test runs in the default namespace, the admin stream has the failed authentication as well
+	broker.AuditSink = simp_broker.MultiAuditSink(log.Audit, broker.AdminAuditSink("", "$SYS.audit"))
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	auditor := &simp_client.SimpClient{Id: "auditor", SimpBrokerHost: "localhost:8090", Token: "audit", AuthMechanism: simp_client.MechanismPlain}
+	err = auditor.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditor.Close()
+	events := make(chan simp_broker.AuditEvent, 16)
+	err = auditor.Subscribe("$SYS.audit", func(bytes []byte) {
+		event := simp_broker.AuditEvent{}
+		json.Unmarshal(bytes, &event)
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intruder := &simp_client.SimpClient{Id: "intruder", SimpBrokerHost: "localhost:8090", Token: "guess", AuthMechanism: simp_client.MechanismPlain}
+	err = intruder.ConnectToServer()
+	if err == nil {
+		intruder.Close()
+		t.Fatal("intruder must be rejected")
+	}
+	err = auditor.Publish("secrets", []byte("leak"))
+	if err == nil {
+		t.Fatal("publish to secrets must be denied")
+	}
+	for _, expected := range []simp_broker.AuditKind{simp_broker.AuditAuthFailure, simp_broker.AuditACLDenied} {
+		select {
+		case event := <-events:
+			if event.Kind != expected {
+				t.Errorf("expected a %s event, got %+v", expected, event)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("no %s event was published", expected)
+		}
+	}
+
+	//every event goes to a new file with a max size of 1 byte, the oldest is in the last backup
+	lines := make([]string, 0, 3)
+	for _, file := range []string{path + ".2", path + ".1", path} {
+		bytes, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(string(bytes)))
+	}
+	first := simp_broker.AuditEvent{}
+	err = json.Unmarshal([]byte(lines[0]), &first)
+	if err != nil || first.Kind != simp_broker.AuditAuthSuccess || first.ClientID != "auditor" || len(first.RemoteAddr) == 0 {
+		t.Errorf("unexpected first audit line %s", lines[0])
+	}
+}
+
+func TestAuditEventsStayInTheirNamespace(t *testing.T) {
+	acl := &simp_broker.ACL{Rules: []simp_broker.ACLRule{
+		{Effect: "deny", Actions: []simp_broker.Action{simp_broker.ActionPublish}, Topics: []string{"secrets"}},
+	}, DefaultAllow: true}
+	broker := &simp_broker.SimpBroker{
+		Id:   "tenant_audit_broker",
+		Port: "8113",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			if deets.Token == "guess" {
+				return errors.New("failed to authenticate")
+			}
+			//the token names the team in this test
+			deets.Namespace = deets.Token
+			return nil
+		},
+		Authorizer: acl.Authorize,
+	}
+	for _, name := range []string{"team-a", "team-b", "ops"} {
+		err := broker.AddNamespace(&simp_broker.Namespace{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	broker.AuditSink = simp_broker.MultiAuditSink(broker.SystemTopicAuditSink("$SYS.audit"), broker.AdminAuditSink("ops", "$SYS.audit"))
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	events := make(map[string]chan simp_broker.AuditEvent)
+	clients := make(map[string]*simp_client.SimpClient)
+	for _, team := range []string{"team-a", "team-b", "ops"} {
+		client := &simp_client.SimpClient{Id: "watcher", SimpBrokerHost: "localhost:8113", Token: team, AuthMechanism: simp_client.MechanismPlain}
+		err = client.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		ch := make(chan simp_broker.AuditEvent, 16)
+		events[team] = ch
+		clients[team] = client
+		err = client.Subscribe("$SYS.audit", func(bytes []byte) {
+			event := simp_broker.AuditEvent{}
+			json.Unmarshal(bytes, &event)
+			ch <- event
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, team := range []string{"team-b", "team-a"} {
+		err = clients[team].Publish("secrets", []byte("leak"))
+		if err == nil {
+			t.Fatal("publish to secrets must be denied")
+		}
+	}
+	intruder := &simp_client.SimpClient{Id: "intruder", SimpBrokerHost: "localhost:8113", Token: "guess", AuthMechanism: simp_client.MechanismPlain}
+	err = intruder.ConnectToServer()
+	if err == nil {
+		intruder.Close()
+		t.Fatal("intruder must be rejected")
+	}
+
+	//the operators see the denials of both teams and the failed authentication
+	expected := map[string]bool{"acl.denied team-a": true, "acl.denied team-b": true, "auth.failure ": true}
+	for len(expected) > 0 {
+		select {
+		case event := <-events["ops"]:
+			delete(expected, string(event.Kind)+" "+event.Namespace)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("admin stream is missing %v", expected)
+		}
+	}
+	//a team sees its own denial and nothing of the other team or the intruder
+	for _, team := range []string{"team-a", "team-b"} {
+		denied := 0
+	collect:
+		for {
+			select {
+			case event := <-events[team]:
+				if event.Namespace != team || event.Kind == simp_broker.AuditAuthFailure {
+					t.Errorf("%s received an event it must not see %+v", team, event)
+				}
+				if event.Kind == simp_broker.AuditACLDenied {
+					denied++
+				}
+			case <-time.After(time.Millisecond * 200):
+				break collect
+			}
+		}
+		if denied != 1 {
+			t.Errorf("%s expected its own denial once, got %d", team, denied)
+		}
+	}
+}
+
+func TestEncryptedPayloadNeedsTheKey(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "e2e_broker",
+		Port: "8091",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	keys := simp_client.StaticKeys{"k1": []byte("0123456789abcdef0123456789abcdef")}
+	reader := &simp_client.SimpClient{Id: "key_holder", SimpBrokerHost: "localhost:8091", KeyProvider: keys}
+	err = reader.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	plain := make(chan string, 1)
+	err = reader.Subscribe("patients", func(bytes []byte) {
+		plain <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := make(chan error, 1)
+	outsider := &simp_client.SimpClient{Id: "no_key", SimpBrokerHost: "localhost:8091"}
+	outsider.OnDecryptionError = func(err error) {
+		failures <- err
+	}
+	err = outsider.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+	err = outsider.Subscribe("patients", func(bytes []byte) {
+		t.Errorf("message must not reach a subscriber without the key, got %q", bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &simp_client.SimpClient{Id: "e2e_publisher", SimpBrokerHost: "localhost:8091", KeyProvider: keys, EncryptionKeyID: "k1"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	err = publisher.Publish("patients", []byte("jane doe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-plain:
+		if msg != "jane doe" {
+			t.Errorf("expected the decrypted payload, got %q", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("encrypted message was not delivered")
+	}
+	select {
+	case err := <-failures:
+		decryptionErr := &simp_client.DecryptionError{}
+		if !errors.As(err, &decryptionErr) || decryptionErr.KeyID != "k1" {
+			t.Errorf("expected a decryption error for key k1, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("subscriber without the key was not told")
+	}
+}
+
+func TestUndecryptableMessagesDoNotStallTheSubscription(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "keyless_broker",
+		Port: "8104",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	failed := make(chan error, 100)
+	outsider := &simp_client.SimpClient{Id: "keyless_subscriber", SimpBrokerHost: "localhost:8104", Prefetch: 4}
+	outsider.OnDecryptionError = func(err error) {
+		failed <- err
+	}
+	err = outsider.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+	plain := make(chan string, 10)
+	err = outsider.Subscribe("records", func(bytes []byte) {
+		plain <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := simp_client.StaticKeys{"k1": []byte("0123456789abcdef0123456789abcdef")}
+	sealed := &simp_client.SimpClient{Id: "sealed_publisher", SimpBrokerHost: "localhost:8104", KeyProvider: keys, EncryptionKeyID: "k1"}
+	err = sealed.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sealed.Close()
+	//three times the prefetch, every one of them used a credit
+	for i := 0; i < 12; i++ {
+		err = sealed.Publish("records", []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		select {
+		case <-failed:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only %d of 12 encrypted messages reached the subscriber", i)
+		}
+	}
+
+	open := &simp_client.SimpClient{Id: "open_publisher", SimpBrokerHost: "localhost:8104"}
+	err = open.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	err = open.Publish("records", []byte("public"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-plain:
+		if msg != "public" {
+			t.Errorf("expected the plaintext message, got %q", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("subscription stalled after the undecryptable messages")
+	}
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "tenant_broker",
+		Port: "8092",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			//the token names the team in this test
+			deets.Namespace = deets.Token
+			return nil
+		},
+	}
+	for _, name := range []string{"team-a", "team-b"} {
+		err := broker.AddNamespace(&simp_broker.Namespace{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(map[string]chan string)
+	removed := make(chan string, 1)
+	for _, team := range []string{"team-a", "team-b"} {
+		//the same client id in both namespaces does not conflict
+		client := &simp_client.SimpClient{Id: "worker", SimpBrokerHost: "localhost:8092", Token: team, AuthMechanism: simp_client.MechanismPlain}
+		client.OnSessionTakenOver = func(reason string) {
+			removed <- reason
+		}
+		err = client.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		ch := make(chan string, 4)
+		received[team] = ch
+		err = client.Subscribe("jobs", func(bytes []byte) {
+			ch <- string(bytes)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publisher := &simp_client.SimpClient{Id: "scheduler", SimpBrokerHost: "localhost:8092", Token: "team-a", AuthMechanism: simp_client.MechanismPlain}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	err = publisher.Publish("jobs", []byte("for team a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received["team-a"]:
+		if msg != "for team a" {
+			t.Errorf("unexpected message %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message was not delivered within its namespace")
+	}
+	select {
+	case msg := <-received["team-b"]:
+		t.Errorf("message leaked to another namespace: %s", msg)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	namespaces := broker.Namespaces()
+	if len(namespaces) != 3 || namespaces[1].Name != "team-a" || len(namespaces[1].Clients) != 2 || namespaces[2].Topics[0] != "jobs" {
+		t.Errorf("unexpected namespaces %+v %+v %+v", namespaces[0], namespaces[1], namespaces[2])
+	}
+	stranger := &simp_client.SimpClient{Id: "stranger", SimpBrokerHost: "localhost:8092", Token: "team-c", AuthMechanism: simp_client.MechanismPlain}
+	err = stranger.ConnectToServer()
+	if err == nil {
+		stranger.Close()
+		t.Error("client of an unknown namespace must be rejected")
+	}
+	err = broker.RemoveNamespace("team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-removed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("client of a removed namespace was not disconnected")
+	}
+}
+
+func TestConsoleManagesNamespaces(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "console_broker",
+		Port: "8131",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			deets.Namespace = deets.Token
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	out := &bytes.Buffer{}
+	runConsole(broker, strings.NewReader("addnamespace team-x 1\naddnamespace team-x\nnamespaces\n"), out)
+	if !strings.Contains(out.String(), "namespace team-x added") || !strings.Contains(out.String(), "already exists") || !strings.Contains(out.String(), "team-x clients: []") {
+		t.Errorf("unexpected console output %q", out.String())
+	}
+	client := &simp_client.SimpClient{Id: "tenant", SimpBrokerHost: "localhost:8131", Token: "team-x", AuthMechanism: simp_client.MechanismPlain}
+	removed := make(chan string, 1)
+	client.OnSessionTakenOver = func(reason string) {
+		removed <- reason
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	second := &simp_client.SimpClient{Id: "second_tenant", SimpBrokerHost: "localhost:8131", Token: "team-x", AuthMechanism: simp_client.MechanismPlain}
+	err = second.ConnectToServer()
+	if err == nil {
+		second.Close()
+		t.Error("namespace added with a limit of 1 connection took a second one")
+	}
+
+	out.Reset()
+	runConsole(broker, strings.NewReader("removenamespace team-x\nbogus\n"), out)
+	if !strings.Contains(out.String(), "namespace team-x removed") || !strings.Contains(out.String(), "unknown command bogus") {
+		t.Errorf("unexpected console output %q", out.String())
+	}
+	select {
+	case <-removed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("client of the removed namespace was not disconnected")
+	}
+}
+
+func TestPublishGivesUpWhenTheAckIsLate(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "slow_broker",
+		Port: "8093",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		//throttling holds back the ack of the second message for about two seconds
+		Limits: &simp_broker.Limits{MessagesPerSecond: 0.5, BurstSeconds: 2},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	client := &simp_client.SimpClient{Id: "impatient_client", SimpBrokerHost: "localhost:8093"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Publish("slow", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	err = client.PublishCtx(ctx, "slow", []byte("second"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("publish did not give up at the deadline, took %v", took)
+	}
+	client.OperationTimeout = time.Millisecond * 100
+	err = client.Publish("slow", []byte("third"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the operation timeout to be exceeded, got %v", err)
+	}
+}
+
+func TestClientReconnectsAndRestoresSubscriptions(t *testing.T) {
+	newBroker := func() *simp_broker.SimpBroker {
+		return &simp_broker.SimpBroker{
+			Id:   "restarting_broker",
+			Port: "8094",
+			Authenticator: func(deets *simp_broker.AuthDetails) error {
+				return nil
+			},
+		}
+	}
+	broker := newBroker()
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disconnected, reconnected := make(chan error, 1), make(chan bool, 1)
+	recieved := make(chan string, 1)
+	client := &simp_client.SimpClient{
+		Id:                "resilient_client",
+		SimpBrokerHost:    "localhost:8094",
+		AutoReconnect:     true,
+		ReconnectBackoff:  time.Millisecond * 50,
+		MaxReconnectDelay: time.Millisecond * 200,
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+		OnReconnect: func() {
+			reconnected <- true
+		},
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Subscribe("heartbeat", func(bytes []byte) {
+		recieved <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("lost connection was not reported")
+	}
+	if state := client.State(); state != simp_client.StateReconnecting {
+		t.Errorf("expected the client to be reconnecting, it is %s", state)
+	}
+	//the old broker releases the port in the background
+	broker = newBroker()
+	for i := 0; i < 20; i++ {
+		err = broker.Serve()
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("client did not reconnect")
+	}
+	if state := client.State(); state != simp_client.StateConnected {
+		t.Errorf("expected the client to be connected, it is %s", state)
+	}
+
+	publisher := &simp_client.SimpClient{Id: "heart", SimpBrokerHost: "localhost:8094"}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	err = publisher.Publish("heartbeat", []byte("beat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-recieved:
+		if msg != "beat" {
+			t.Errorf("expected beat, got %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("restored subscription did not recieve the message")
+	}
+}
+
+func TestUnackedPublishesAreResentInOrder(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "resend_broker",
+		Port: "8114",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	relayed, swallowing := startSwallowingRelay(t, "localhost:8115", "localhost:8114")
+	received := make(chan string, 64)
+	subscriber := &simp_client.SimpClient{Id: "resend_subscriber", SimpBrokerHost: "localhost:8114"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	err = subscriber.Subscribe("ordered", func(bytes []byte) {
+		received <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconnected := make(chan bool, 1)
+	publisher := &simp_client.SimpClient{
+		Id:               "resend_publisher",
+		SimpBrokerHost:   "localhost:8115",
+		AutoReconnect:    true,
+		ResendPending:    true,
+		ReconnectBackoff: time.Millisecond * 50,
+		OnReconnect: func() {
+			reconnected <- true
+		},
+	}
+	err = publisher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	first := <-relayed
+	atomic.StoreInt32(swallowing, 1)
+	futures := make([]*simp_client.PublishFuture, 0, 16)
+	for i := 0; i < 16; i++ {
+		future, err := publisher.PublishAsync("ordered", []byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	//the broker routed every publish, the acks never arrived
+	for i := 0; i < 16; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatal("publishes did not reach the broker")
+		}
+	}
+	first.Close()
+	atomic.StoreInt32(swallowing, 0)
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("publisher did not reconnect")
+	}
+	for i := 0; i < 16; i++ {
+		select {
+		case msg := <-received:
+			if msg != fmt.Sprint(i) {
+				t.Fatalf("expected publish %d to be resent next, got %s", i, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("unacked publishes were not resent")
+		}
+	}
+	for _, future := range futures {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		err = future.Wait(ctx)
+		cancel()
+		if err != nil {
+			t.Errorf("resent publish must be acked, got %v", err)
+		}
+	}
+}
+
+func TestOutboxQueuesPublishesWhileDisconnected(t *testing.T) {
+	newBroker := func() *simp_broker.SimpBroker {
+		return &simp_broker.SimpBroker{
+			Id:   "outbox_broker",
+			Port: "8095",
+			Authenticator: func(deets *simp_broker.AuthDetails) error {
+				return nil
+			},
+		}
+	}
+	broker := newBroker()
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := simp_client.NewFileOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnected := make(chan error, 1)
+	recieved := make(chan string, 3)
+	client := &simp_client.SimpClient{
+		Id:                "outbox_client",
+		SimpBrokerHost:    "localhost:8095",
+		AutoReconnect:     true,
+		ReconnectBackoff:  time.Millisecond * 50,
+		MaxReconnectDelay: time.Millisecond * 200,
+		Outbox:            outbox,
+		OutboxSize:        2,
+		OutboxOverflow:    simp_client.OverflowError,
+		OnDisconnect: func(err error) {
+			disconnected <- err
+		},
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//the client recieves its own publishes, its subscription is restored before the outbox is flushed
+	err = client.Subscribe("orders", func(bytes []byte) {
+		recieved <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second * 5):
+		t.Fatal("lost connection was not reported")
+	}
+	first, err := client.PublishBuffered("orders", []byte("first"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.PublishBuffered("orders", []byte("second"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.PublishBuffered("orders", []byte("third"), nil)
+	if err != simp_client.ErrOutboxFull {
+		t.Errorf("expected a full outbox, got %v", err)
+	}
+	if outbox.Len() != 2 {
+		t.Errorf("expected 2 publishes in the outbox, got %d", outbox.Len())
+	}
+
+	broker = newBroker()
+	for i := 0; i < 20; i++ {
+		err = broker.Serve()
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, future := range []*simp_client.PublishFuture{first, second} {
+		err = future.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case msg := <-recieved:
+			if msg != expected {
+				t.Errorf("expected %s, got %s", expected, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("did not recieve %s", expected)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the flushed outbox to be empty on disk, it has %d files", len(entries))
+	}
+}
+
+func TestOutboxKeepsAPublishUntilItIsAcked(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "outbox_ack_broker",
+		Port: "8116",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	relayed, swallowing := startSwallowingRelay(t, "localhost:8117", "localhost:8116")
+
+	received := make(chan string, 4)
+	subscriber := &simp_client.SimpClient{Id: "outbox_ack_subscriber", SimpBrokerHost: "localhost:8116"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	err = subscriber.Subscribe("invoices", func(bytes []byte) {
+		received <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := &simp_client.MemoryOutbox{}
+	//without ResendPending, the outbox alone must carry the publish over the reconnect
+	client := &simp_client.SimpClient{
+		Id:               "outbox_ack_client",
+		SimpBrokerHost:   "localhost:8117",
+		AutoReconnect:    true,
+		ReconnectBackoff: time.Millisecond * 50,
+		Outbox:           outbox,
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	first := <-relayed
+	atomic.StoreInt32(swallowing, 1)
+	future, err := client.PublishBuffered("invoices", []byte("invoice"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("publish did not reach the broker")
+	}
+	if future.Err() != nil || outbox.Len() != 1 {
+		t.Errorf("unacked publish must stay in the outbox, it holds %d with error %v", outbox.Len(), future.Err())
+	}
+	first.Close()
+	atomic.StoreInt32(swallowing, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = future.Wait(ctx)
+	if err != nil {
+		t.Fatalf("publish lost with the connection: %v", err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "invoice" {
+			t.Errorf("expected the invoice to be sent again, got %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("unacked publish was not sent again")
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("acked publish must leave the outbox, it holds %d", outbox.Len())
+	}
+}
+
+func TestOutboxSendsAPublishAgainWhenItsAckIsLate(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "late_ack_broker",
+		Port: "8127",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	_, swallowing := startSwallowingRelay(t, "localhost:8128", "localhost:8127")
+
+	received := make(chan string, 4)
+	subscriber := &simp_client.SimpClient{Id: "late_ack_subscriber", SimpBrokerHost: "localhost:8127"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	err = subscriber.Subscribe("receipts", func(bytes []byte) {
+		received <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := &simp_client.MemoryOutbox{}
+	client := &simp_client.SimpClient{
+		Id:               "late_ack_client",
+		SimpBrokerHost:   "localhost:8128",
+		OperationTimeout: time.Millisecond * 300,
+		Outbox:           outbox,
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	atomic.StoreInt32(swallowing, 1)
+	future, err := client.PublishBuffered("receipts", []byte("receipt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the connection stays up, the pump gives up on the ack and sends the publish again
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("publish was sent %d times, expected it again after the timeout", i)
+		}
+	}
+	if future.Err() != nil || outbox.Len() != 1 {
+		t.Errorf("unacked publish must stay in the outbox, it holds %d with error %v", outbox.Len(), future.Err())
+	}
+	atomic.StoreInt32(swallowing, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = future.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 0 {
+		t.Errorf("acked publish must leave the outbox, it holds %d", outbox.Len())
+	}
+}
+
+func TestPublishAsyncPipelinesAndBatches(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "pipelining_broker",
+		Port: "8096",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		Authorizer: func(deets *simp_broker.AuthDetails, action simp_broker.Action, topic string) error {
+			if topic == "forbidden" {
+				return fmt.Errorf("%s is forbidden", topic)
+			}
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	const count = 200
+	recieved := make(chan string, count*2)
+	subscriber := &simp_client.SimpClient{Id: "pipelined_subscriber", SimpBrokerHost: "localhost:8096"}
+	err = subscriber.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	err = subscriber.Subscribe("ticks", func(bytes []byte) {
+		recieved <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipelined := &simp_client.SimpClient{Id: "pipelined_publisher", SimpBrokerHost: "localhost:8096"}
+	batching := &simp_client.SimpClient{
+		Id:             "batching_publisher",
+		SimpBrokerHost: "localhost:8096",
+		BatchLinger:    time.Millisecond * 5,
+		MaxBatchSize:   32,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for _, publisher := range []*simp_client.SimpClient{pipelined, batching} {
+		err = publisher.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer publisher.Close()
+		futures := make([]*simp_client.PublishFuture, 0, count)
+		for i := 0; i < count; i++ {
+			future, err := publisher.PublishAsync("ticks", []byte(fmt.Sprint(i)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			futures = append(futures, future)
+		}
+		refused, err := publisher.PublishAsync("forbidden", []byte("nope"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, future := range futures {
+			err = future.Wait(ctx)
+			if err != nil {
+				t.Fatalf("%s: %v", publisher.Id, err)
+			}
+		}
+		if refused.Wait(ctx) == nil {
+			t.Errorf("%s: expected the publish to a forbidden topic to fail", publisher.Id)
+		}
+		for i := 0; i < count; i++ {
+			select {
+			case msg := <-recieved:
+				if msg != fmt.Sprint(i) {
+					t.Fatalf("%s: expected %d, got %s", publisher.Id, i, msg)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("%s: recieved only %d of %d messages", publisher.Id, i, count)
+			}
+		}
+	}
+}
+
+func TestPublishAsyncFailsWhenTheAckNeverComes(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "silent_broker",
+		Port: "8129",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	_, swallowing := startSwallowingRelay(t, "localhost:8130", "localhost:8129")
+
+	client := &simp_client.SimpClient{
+		Id:               "impatient_client",
+		SimpBrokerHost:   "localhost:8130",
+		OperationTimeout: time.Millisecond * 200,
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	atomic.StoreInt32(swallowing, 1)
+	future, err := client.PublishAsync("void", []byte("hello?"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = future.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+		t.Fatalf("expected the future to fail after the OperationTimeout, got %v", err)
+	}
+	//nothing is left waiting, so a drain does not wait for the lost ack
+	start := time.Now()
+	err = client.Drain(ctx)
+	if err != nil || time.Since(start) > time.Second {
+		t.Errorf("drain waited %v for a publish already given up on: %v", time.Since(start), err)
+	}
+}
+
+func TestConcurrentPublishesGetTheirOwnAcks(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "busy_broker",
+		Port: "8097",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+		//every other topic is refused so a publish seeing the ack of another fails the test
+		Authorizer: func(deets *simp_broker.AuthDetails, action simp_broker.Action, topic string) error {
+			if strings.HasPrefix(topic, "refused") {
+				return fmt.Errorf("%s is refused", topic)
+			}
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "busy_client", SimpBrokerHost: "localhost:8097"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const publishers, each = 50, 100
+	errs := make(chan error, publishers*each)
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				topic := fmt.Sprintf("accepted/%d", p)
+				if (p+i)%2 == 1 {
+					topic = fmt.Sprintf("refused/%d", p)
+				}
+				err := client.Publish(topic, []byte("payload"))
+				refused := strings.HasPrefix(topic, "refused")
+				if refused && (err == nil || !strings.Contains(err.Error(), topic)) {
+					errs <- fmt.Errorf("publish to %s expected its refusal, got %v", topic, err)
+				} else if !refused && err != nil {
+					errs <- fmt.Errorf("publish to %s failed: %v", topic, err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSubscribeChanSelectsAcrossTopics(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "channel_broker",
+		Port: "8098",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "channel_client", SimpBrokerHost: "localhost:8098"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	orders, ordersSub, err := client.SubscribeChan("orders", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts, alertsSub, err := client.SubscribeChan("alerts", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"orders", "alerts", "orders"} {
+		err = client.PublishWithOptions(topic, []byte(topic), &simp_client.PubOptions{Headers: map[string]string{"source": "test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts := map[string]int{}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-orders:
+			counts[msg.Topic]++
+		case msg := <-alerts:
+			if msg.Headers["source"] != "test" {
+				t.Errorf("expected the headers with the message, got %v", msg.Headers)
+			}
+			counts[msg.Topic]++
+		case <-time.After(time.Second * 5):
+			t.Fatalf("recieved only %v", counts)
+		}
+	}
+	if counts["orders"] != 2 || counts["alerts"] != 1 {
+		t.Errorf("expected 2 orders and 1 alert, got %v", counts)
+	}
+
+	//nobody reads alerts, the first message fills its channel and the rest are dropped
+	for i := 0; i < 5; i++ {
+		err = client.Publish("alerts", []byte("alert"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for alertsSub.Dropped() < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if alertsSub.Dropped() != 4 {
+		t.Errorf("expected 4 dropped alerts, got %d", alertsSub.Dropped())
+	}
+
+	err = ordersSub.Unsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-orders; open {
+		t.Error("expected the channel to be closed after Unsubscribe")
+	}
+	if ordersSub.Err() != nil {
+		t.Errorf("expected no error after Unsubscribe, got %v", ordersSub.Err())
+	}
+	client.Close()
+	<-alerts
+	if _, open := <-alerts; open {
+		t.Error("expected the channel to be closed after Close")
+	}
+	if alertsSub.Err() != simp_client.ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", alertsSub.Err())
+	}
+}
+
+func TestListenersShareOneSubscription(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "sharing_broker",
+		Port: "8099",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "component_host", SimpBrokerHost: "localhost:8099"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	billing, audit := make(chan string, 10), make(chan string, 10)
+	billingSub, err := client.SubscribeListener("news", func(bytes []byte) {
+		billing <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditSub, err := client.SubscribeListener("news", func(bytes []byte) {
+		audit <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, feedSub, err := client.SubscribeChan("news", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(ch <-chan string, expected string) {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			if msg != expected {
+				t.Errorf("expected %s, got %s", expected, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("did not recieve %s", expected)
+		}
+	}
+	topics := func() []string {
+		for _, ns := range broker.Namespaces() {
+			if ns.Name == "" {
+				return ns.Topics
+			}
+		}
+		return nil
+	}
+
+	err = client.Publish("news", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(billing, "first")
+	expect(audit, "first")
+	select {
+	case msg := <-feed:
+		if string(msg.Data) != "first" {
+			t.Errorf("expected first on the channel, got %s", msg.Data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("channel did not recieve first")
+	}
+
+	err = billingSub.Unsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish("news", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(audit, "second")
+	<-feed
+	select {
+	case msg := <-billing:
+		t.Errorf("unsubscribed listener recieved %s", msg)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if len(topics()) != 1 {
+		t.Errorf("expected the broker to keep the subscription while listeners remain, topics %v", topics())
+	}
+
+	err = auditSub.Unsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = feedSub.Unsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-feed; open {
+		t.Error("expected the channel to be closed")
+	}
+	if len(topics()) != 0 {
+		t.Errorf("expected the last Unsubscribe to reach the broker, topics %v", topics())
+	}
+}
+
+type testOrder struct {
+	ID     int     `json:"id"`
+	Amount float64 `json:"amount"`
+}
+
+func TestSlowListenerOnlyHoldsUpTheBroker(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "paced_broker",
+		Port: "8118",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "paced_client", SimpBrokerHost: "localhost:8118", Prefetch: 4}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	gate := make(chan bool)
+	slow, fast := make(chan string, 10), make(chan string, 10)
+	_, err = client.SubscribeListener("ticks", func(bytes []byte) {
+		<-gate
+		slow <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.SubscribeListener("ticks", func(bytes []byte) {
+		fast <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = client.Publish("ticks", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the fast listener goes on until the blocked one holds every credit of the window
+	for i := 0; i < 4; i++ {
+		select {
+		case msg := <-fast:
+			if msg != fmt.Sprint(i) {
+				t.Errorf("expected %d, got %s", i, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("fast listener was held up by the slow one at %d", i)
+		}
+	}
+	select {
+	case msg := <-fast:
+		t.Errorf("broker went beyond the credits of the slowest listener with %s", msg)
+	case <-time.After(time.Millisecond * 200):
+	}
+	close(gate)
+	for _, ch := range []chan string{slow, fast} {
+		start := 0
+		if ch == fast {
+			start = 4
+		}
+		for i := start; i < 10; i++ {
+			select {
+			case msg := <-ch:
+				if msg != fmt.Sprint(i) {
+					t.Errorf("expected %d, got %s", i, msg)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("listener did not recieve %d once the slow one caught up", i)
+			}
+		}
+	}
+}
+
+func TestListenerJoiningWhileTheLastLeavesKeepsRecieving(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "churn_broker",
+		Port: "8119",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "churn_client", SimpBrokerHost: "localhost:8119"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for round := 0; round < 30; round++ {
+		leaving, err := client.SubscribeListener("churn", func(bytes []byte) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan string, 1)
+		var joining simp_client.Subscription
+		var joinErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			leaving.Unsubscribe()
+		}()
+		go func() {
+			defer wg.Done()
+			//lands before, during and after the unsubscription at the broker across the rounds
+			time.Sleep(time.Duration(round) * time.Microsecond * 10)
+			joining, joinErr = client.SubscribeListener("churn", func(bytes []byte) {
+				select {
+				case received <- string(bytes):
+				default:
+				}
+			})
+		}()
+		wg.Wait()
+		if joinErr != nil {
+			t.Fatal(joinErr)
+		}
+		err = client.Publish("churn", []byte(fmt.Sprint(round)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if msg != fmt.Sprint(round) {
+				t.Errorf("expected %d, got %s", round, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("joining listener was left without a subscription in round %d", round)
+		}
+		err = joining.Unsubscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTypedTopicDecodesAndReportsBadMessages(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "typed_broker",
+		Port: "8100",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "typed_client", SimpBrokerHost: "localhost:8100"}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	orders := simp_client.NewTypedTopic[testOrder](client, "orders", nil)
+	decodeErrors := make(chan error, 2)
+	orders.OnDecodeError = func(err error) {
+		decodeErrors <- err
+	}
+	recieved := make(chan testOrder, 1)
+	_, err = orders.Subscribe(func(order testOrder, meta simp_client.Metadata) {
+		if meta.ContentType != "application/json" || meta.Topic != "orders" {
+			t.Errorf("unexpected metadata %+v", meta)
+		}
+		recieved <- order
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	//neither raw bytes nor another content type reach the handler
+	err = client.Publish("orders", []byte("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PublishWithOptions("orders", []byte("<order/>"), &simp_client.PubOptions{
+		Headers: map[string]string{simp_client.HeaderContentType: "application/xml"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orders.Publish(ctx, testOrder{ID: 7, Amount: 9.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case order := <-recieved:
+		if order.ID != 7 || order.Amount != 9.5 {
+			t.Errorf("expected order 7 of 9.5, got %+v", order)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("typed message was not recieved")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-decodeErrors:
+			var decodeErr *simp_client.DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Errorf("expected a DecodeError, got %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("bad message was not reported")
+		}
+	}
+}
+
+func TestInterceptorsWrapPublishesAndDeliveries(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "intercepted_broker",
+		Port: "8101",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	metrics := &simp_client.Metrics{}
+	client := &simp_client.SimpClient{
+		Id:             "intercepted_client",
+		SimpBrokerHost: "localhost:8101",
+		PublishInterceptors: []simp_client.PublishInterceptor{
+			metrics.Publish,
+			//validation, empty payloads never leave the client
+			func(ctx context.Context, message *simp_client.Message, next simp_client.PublishHandler) error {
+				if len(message.Data) == 0 {
+					return errors.New("empty payload")
+				}
+				message.Headers["trace-id"] = "trace-1"
+				return next(ctx, message)
+			},
+		},
+		DeliverInterceptors: []simp_client.DeliverInterceptor{
+			metrics.Deliver,
+			func(message *simp_client.Message, next simp_client.DeliverHandler) error {
+				if message.Headers["trace-id"] != "trace-1" {
+					return fmt.Errorf("message without trace id")
+				}
+				message.Data = bytes.ToUpper(message.Data)
+				return next(message)
+			},
+		},
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	recieved := make(chan string, 1)
+	err = client.Subscribe("traced", func(bytes []byte) {
+		recieved <- string(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Publish("traced", nil)
+	if err == nil || !strings.Contains(err.Error(), "empty payload") {
+		t.Errorf("expected the interceptor to refuse the publish, got %v", err)
+	}
+	err = client.Publish("traced", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-recieved:
+		if msg != "HELLO" {
+			t.Errorf("expected the delivery interceptor to change the payload, got %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("intercepted message was not delivered")
+	}
+	snapshot := metrics.Snapshot()
+	if snapshot.Published != 1 || snapshot.PublishFailures != 1 || snapshot.Delivered != 1 {
+		t.Errorf("unexpected metrics %+v", snapshot)
+	}
+	if snapshot.PublishLatency <= 0 {
+		t.Errorf("expected the publish latency to be observed, got %v", snapshot.PublishLatency)
+	}
+}
+
+func TestFrameSizeIsNegotiated(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:               "roomy_broker",
+		Port:             "8102",
+		MaxMessageBuffer: 4096,
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	roomy := &simp_client.SimpClient{Id: "roomy_client", SimpBrokerHost: "localhost:8102"}
+	narrow := &simp_client.SimpClient{Id: "narrow_client", SimpBrokerHost: "localhost:8102", MaxFrameSize: 1500}
+	for _, client := range []*simp_client.SimpClient{roomy, narrow} {
+		err = client.ConnectToServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	roomyRecieved, narrowRecieved := make(chan int, 2), make(chan int, 2)
+	err = roomy.Subscribe("blobs", func(bytes []byte) {
+		roomyRecieved <- len(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = narrow.Subscribe("blobs", func(bytes []byte) {
+		narrowRecieved <- len(bytes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//over 1KB, the client takes the limit of the broker
+	big := bytes.Repeat([]byte("x"), 2000)
+	err = roomy.Publish("blobs", big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-roomyRecieved:
+		if size != len(big) {
+			t.Errorf("expected %d bytes, got %d", len(big), size)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("big message was not recieved")
+	}
+	err = narrow.Publish("blobs", big)
+	if !errors.Is(err, simp_client.ErrFrameTooLarge) {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+	//the narrow connection still works, it only missed the message too big for it
+	err = narrow.Publish("blobs", []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-narrowRecieved:
+		if size != len("small") {
+			t.Errorf("expected only the small message on the narrow client, got %d bytes", size)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("small message was not recieved")
+	}
+}
+
+func TestDrainFinishesInFlightWorkBeforeClosing(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "draining_broker",
+		Port: "8103",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	client := &simp_client.SimpClient{Id: "draining_client", SimpBrokerHost: "localhost:8103", BatchLinger: time.Second}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	updates, updatesSub, err := client.SubscribeChan("updates", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultNamespace := func() *simp_broker.NamespaceInfo {
+		for _, ns := range broker.Namespaces() {
+			if ns.Name == "" {
+				return ns
+			}
+		}
+		return &simp_broker.NamespaceInfo{}
+	}
+
+	//the linger is far away, Drain sends the batch right away
+	futures := make([]*simp_client.PublishFuture, 0, 10)
+	for i := 0; i < 10; i++ {
+		future, err := client.PublishAsync("updates", []byte(fmt.Sprint(i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = client.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, future := range futures {
+		select {
+		case <-future.Done():
+			if future.Err() != nil {
+				t.Errorf("expected the publish to be acknowledged, got %v", future.Err())
+			}
+		default:
+			t.Error("Drain returned before a publish was acknowledged")
+		}
+	}
+	err = client.Publish("updates", []byte("late"))
+	if !errors.Is(err, simp_client.ErrDraining) {
+		t.Errorf("expected ErrDraining, got %v", err)
+	}
+	if client.State() != simp_client.StateClosed {
+		t.Errorf("expected the client to be closed, it is %s", client.State())
+	}
+	for range updates {
+	}
+	if updatesSub.Err() != nil {
+		t.Errorf("expected the subscription to end by unsubscribing, got %v", updatesSub.Err())
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(defaultNamespace().Clients) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if ns := defaultNamespace(); len(ns.Clients) != 0 || len(ns.Topics) != 0 {
+		t.Errorf("expected the broker to forget the client and its subscription, got %+v", ns)
+	}
+}
+
+//self signed CA with a certificate for the broker on localhost and one for a client named secure_client
+func TestDrainWaitsForPublishesAndFetchesInFlight(t *testing.T) {
+	broker := &simp_broker.SimpBroker{
+		Id:   "patient_broker",
+		Port: "8120",
+		Authenticator: func(deets *simp_broker.AuthDetails) error {
+			return nil
+		},
+	}
+	err := broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	//the interceptor holds the publish after it got past the draining check
+	entered, gate := make(chan bool), make(chan bool)
+	client := &simp_client.SimpClient{Id: "patient_client", SimpBrokerHost: "localhost:8120"}
+	client.PublishInterceptors = []simp_client.PublishInterceptor{
+		func(ctx context.Context, message *simp_client.Message, next simp_client.PublishHandler) error {
+			close(entered)
+			<-gate
+			return next(ctx, message)
+		},
+	}
+	err = client.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	published := make(chan error, 1)
+	go func() {
+		published <- client.Publish("reports", []byte("held"))
+	}()
+	<-entered
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		drained <- client.Drain(ctx)
+	}()
+	select {
+	case err = <-drained:
+		t.Fatalf("Drain returned while a publish was being handed over: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+	close(gate)
+	err = <-published
+	if err != nil {
+		t.Errorf("publish let through before draining must complete, got %v", err)
+	}
+	err = <-drained
+	if err != nil {
+		t.Errorf("expected a clean drain, got %v", err)
+	}
+
+	//a long poll is waited for as well, the DrainError tells the deadline ran out
+	fetcher := &simp_client.SimpClient{Id: "patient_fetcher", SimpBrokerHost: "localhost:8120"}
+	err = fetcher.ConnectToServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fetcher.Close()
+	err = fetcher.SubscribePull("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fetcher.Fetch(context.Background(), "reports", 1, time.Second*5)
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	err = fetcher.Drain(ctx)
+	var drainErr *simp_client.DrainError
+	if !errors.As(err, &drainErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a DrainError with the deadline, got %v", err)
+	}
+}
+
+//relays connections to the broker, while swallowing is set nothing of the broker reaches the client so
+//every publish stays waiting for its ack. each relayed client connection is sent on the channel
+func startSwallowingRelay(t *testing.T, address string, broker string) (chan net.Conn, *int32) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	swallowing := new(int32)
+	relayed := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", broker)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			relayed <- conn
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := upstream.Read(buf)
+					if err != nil {
+						return
+					}
+					if atomic.LoadInt32(swallowing) == 0 {
+						conn.Write(buf[:n])
+					}
+				}
+			}()
+		}
+	}()
+	return relayed, swallowing
+}
+
+func generateTestCertificates(t *testing.T) (*x509.CertPool, tls.Certificate, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "simp_mq test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	issue := func(serial int64, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, issue(2, "localhost", x509.ExtKeyUsageServerAuth), issue(3, "secure_client", x509.ExtKeyUsageClientAuth)
+}
+
 /*
 func TestError(t *testing.T) {
 	defer func() {